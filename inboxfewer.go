@@ -4,23 +4,33 @@
 // https://golang.org/LICENSE
 
 // Inboxfewer archives messages in your gmail inbox if the
-// corresponding github issue has been closed or the gerrit code
-// review has been merged or abandoned.
+// corresponding github or gitlab issue has been closed or the gerrit
+// code review has been merged or abandoned.
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"golang.org/x/build/gerrit"
@@ -32,8 +42,71 @@ import (
 
 var githubUser, githubToken string
 
+// gitlabHost is the GitLab server whose notifications are checked,
+// and the only one gitlabToken is sent to. gitlabToken is optional; it
+// is only needed for private projects.
+var gitlabHost, gitlabToken = "gitlab.com", ""
+
+var dryRun = flag.Bool("dry-run", false, "only report which threads would be archived")
+
+var (
+	watch    = flag.Bool("watch", false, "keep running, doing a cleanup pass every -interval")
+	interval = flag.Duration("interval", 30*time.Minute, "time between cleanup passes with -watch")
+)
+
+var (
+	snooze      = flag.String("snooze", "", "archive the thread with this `ID` until the -until time, then exit")
+	snoozeUntil = flag.String("until", "", "RFC 3339 time at which a -snooze'd thread returns to the inbox")
+	listSnoozed = flag.Bool("list-snoozed", false, "list snoozed threads and when they are due, then exit")
+	unsnooze    = flag.String("unsnooze", "", "cancel the snooze of the comma-separated thread `IDs`, moving them back to the inbox now, then exit")
+)
+
+var (
+	qps     = flag.Float64("qps", 10, "maximum sustained Gmail API requests per second; 0 means unlimited")
+	burst   = flag.Int("burst", 10, "maximum burst of Gmail API requests above -qps")
+	retries = flag.Int("retries", 5, "maximum attempts for a Gmail API request that fails with 429 or 5xx")
+)
+
+var (
+	labelQuery   = flag.String("label-query", "", "apply -label to all messages matching this Gmail `query`, then exit")
+	labelNames   = flag.String("label", "", "comma-separated label `names` to apply with -label-query")
+	labelArchive = flag.Bool("archive", false, "with -label-query, also archive the matching messages")
+	yes          = flag.Bool("yes", false, "with -label-query, don't stop when more than 100 messages match")
+)
+
+// labelConfirmThreshold is the number of messages -label-query will
+// modify without -yes.
+const labelConfirmThreshold = 100
+
+var (
+	rawMessage        = flag.String("raw", "", "save the message with this `ID` to <ID>.eml in the current directory, then exit")
+	maxRawMessageSize = flag.Int64("max-message-size", 25<<20, "largest message, in `bytes`, that -raw will download or -import will upload")
+)
+
+var (
+	pubsubTopic  = flag.String("pubsub-topic", "", "start (or renew) Gmail push notifications to this Cloud Pub/Sub `topic`, then exit")
+	pubsubLabels = flag.String("pubsub-labels", "", "with -pubsub-topic, only notify about messages with these comma-separated label `IDs`")
+	pubsubStop   = flag.Bool("pubsub-stop", false, "stop Gmail push notifications, then exit")
+)
+
+var (
+	importFile   = flag.String("import", "", "import the RFC 822 message in this .eml `file` into the mailbox, then exit")
+	importLabels = flag.String("import-labels", "INBOX", "comma-separated names of existing `labels` to give an -import'ed message")
+)
+
+var untrash = flag.String("untrash", "", "move the comma-separated thread `IDs` out of the trash, then exit")
+
+var logout = flag.Bool("logout", false, "revoke and delete the cached Gmail token, then exit")
+
+var rulesFile = flag.String("rules", "", "optional JSON `file` of extra archive/label/trash rules")
+
+// archiveOn is the -archive-on policy: "merged", "closed" (closed
+// without merging) or "either".
+var archiveOn = flag.String("archive-on", "either", "archive pull request, merge request and code review threads when the change is `merged`, \"closed\" without merging (abandoned), or \"either\"")
+
 type FewerClient struct {
-	svc *gmail.UsersService
+	svc        *gmail.UsersService
+	snoozeFile string // JSON record of snoozed threads; see snooze.go
 }
 
 func (c *FewerClient) ArchiveThread(tid string) error {
@@ -43,6 +116,149 @@ func (c *FewerClient) ArchiveThread(tid string) error {
 	return err
 }
 
+// TrashThread moves the thread to the trash, where Gmail deletes it
+// permanently after 30 days. Unlike ArchiveThread, which only removes
+// the INBOX label, the thread disappears from all label views. It is
+// also distinct from marking a thread as spam.
+func (c *FewerClient) TrashThread(tid string) error {
+	_, err := c.svc.Threads.Trash("me", tid).Do()
+	return err
+}
+
+// UntrashThread restores a thread previously moved to the trash by
+// TrashThread, e.g. by a rule that matched too much. It is run by
+// -untrash.
+func (c *FewerClient) UntrashThread(tid string) error {
+	_, err := c.svc.Threads.Untrash("me", tid).Do()
+	return err
+}
+
+// LabelThread adds the given label IDs to the thread. If archive is
+// true, the INBOX label is removed in the same call.
+func (c *FewerClient) LabelThread(tid string, labelIDs []string, archive bool) error {
+	req := &gmail.ModifyThreadRequest{
+		AddLabelIds: labelIDs,
+	}
+	if archive {
+		req.RemoveLabelIds = []string{"INBOX"}
+	}
+	_, err := c.svc.Threads.Modify("me", tid, req).Do()
+	return err
+}
+
+// lookupLabel returns the ID of the label with the given name, or ""
+// if there is none.
+func (c *FewerClient) lookupLabel(name string) (string, error) {
+	res, err := c.svc.Labels.List("me").Do()
+	if err != nil {
+		return "", err
+	}
+	for _, l := range res.Labels {
+		if l.Name == name {
+			return l.Id, nil
+		}
+	}
+	return "", nil
+}
+
+// existingLabelIDs returns the IDs of the named labels. Unlike LabelID,
+// it never creates a label, so a misspelled name is an error.
+func (c *FewerClient) existingLabelIDs(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	res, err := c.svc.Labels.List("me").Do()
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]string{}
+	for _, l := range res.Labels {
+		byName[l.Name] = l.Id
+	}
+	var ids []string
+	for _, name := range names {
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("no label named %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// LabelID returns the ID of the user label with the given name,
+// creating the label if it doesn't exist yet.
+func (c *FewerClient) LabelID(name string) (string, error) {
+	if id, err := c.lookupLabel(name); id != "" || err != nil {
+		return id, err
+	}
+	l, err := c.svc.Labels.Create("me", &gmail.Label{
+		Name:                  name,
+		LabelListVisibility:   "labelShow",
+		MessageListVisibility: "show",
+	}).Do()
+	if err != nil {
+		return "", fmt.Errorf("creating label %q: %v", name, err)
+	}
+	return l.Id, nil
+}
+
+// batchModifyMax is the most message IDs one Messages.BatchModify
+// call accepts.
+const batchModifyMax = 1000
+
+// LabelAndArchive applies the named labels to every message matching
+// q, optionally archiving them too, creating labels that don't exist
+// yet. It returns the number of messages matched. If dryRun is true,
+// nothing is modified.
+func (c *FewerClient) LabelAndArchive(q string, labels []string, archive, dryRun bool) (int, error) {
+	var ids []string
+	pageToken := ""
+	for {
+		req := c.svc.Messages.List("me").Q(q).MaxResults(500)
+		if pageToken != "" {
+			req.PageToken(pageToken)
+		}
+		res, err := req.Do()
+		if err != nil {
+			return 0, err
+		}
+		for _, m := range res.Messages {
+			ids = append(ids, m.Id)
+		}
+		if res.NextPageToken == "" {
+			break
+		}
+		pageToken = res.NextPageToken
+	}
+	if dryRun || len(ids) == 0 {
+		return len(ids), nil
+	}
+
+	mreq := &gmail.BatchModifyMessagesRequest{}
+	for _, name := range labels {
+		id, err := c.LabelID(name)
+		if err != nil {
+			return 0, err
+		}
+		mreq.AddLabelIds = append(mreq.AddLabelIds, id)
+	}
+	if archive {
+		mreq.RemoveLabelIds = []string{"INBOX"}
+	}
+	for done := 0; done < len(ids); done += batchModifyMax {
+		end := done + batchModifyMax
+		if end > len(ids) {
+			end = len(ids)
+		}
+		mreq.Ids = ids[done:end]
+		if err := c.svc.Messages.BatchModify("me", mreq).Do(); err != nil {
+			return done, err
+		}
+	}
+	return len(ids), nil
+}
+
 func (c *FewerClient) ForeachThread(q string, fn func(*gmail.Thread) error) error {
 	pageToken := ""
 	for {
@@ -79,6 +295,29 @@ func readGithubConfig() {
 	githubUser, githubToken = f[0], f[1]
 }
 
+// readGitlabConfig reads the optional GitLab config file, which holds
+// either a token for gitlab.com or a self-hosted server's host name and
+// a token for it.
+func readGitlabConfig() {
+	file := filepath.Join(HomeDir(), "keys", "gitlab-inboxfewer.token")
+	slurp, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	f := strings.Fields(strings.TrimSpace(string(slurp)))
+	switch len(f) {
+	case 1:
+		gitlabToken = f[0]
+	case 2:
+		gitlabHost, gitlabToken = f[0], f[1]
+	default:
+		log.Fatalf("expected a token, or a host and token, in %v; got %d fields", file, len(f))
+	}
+}
+
 // PopulateThread populates t with its full data. t.Id must be set initially.
 func (c *FewerClient) PopulateThread(t *gmail.Thread) error {
 	req := c.svc.Threads.Get("me", t.Id).Format("full")
@@ -90,7 +329,169 @@ func (c *FewerClient) PopulateThread(t *gmail.Thread) error {
 	return nil
 }
 
+// GetRawMessage returns the full RFC 822 source of the message,
+// including all headers and attachments. The size is checked first, so
+// a message over -max-message-size is never downloaded.
+func (c *FewerClient) GetRawMessage(messageID string) ([]byte, error) {
+	meta, err := c.svc.Messages.Get("me", messageID).Format("minimal").Do()
+	if err != nil {
+		return nil, err
+	}
+	if meta.SizeEstimate > *maxRawMessageSize {
+		return nil, fmt.Errorf("message %v is %d bytes; larger than limit of %d", messageID, meta.SizeEstimate, *maxRawMessageSize)
+	}
+	m, err := c.svc.Messages.Get("me", messageID).Format("raw").Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(m.Raw, "="))
+}
+
+// ImportMessage adds the RFC 822 message raw to the mailbox with the
+// given labels, keeping its original headers and date. Unlike a plain
+// insert, Gmail applies its usual scanning and classification, as if
+// the message had been delivered.
+func (c *FewerClient) ImportMessage(raw []byte, labelIDs []string) (messageID string, err error) {
+	if int64(len(raw)) > *maxRawMessageSize {
+		return "", fmt.Errorf("message is %d bytes; larger than limit of %d", len(raw), *maxRawMessageSize)
+	}
+	if _, err := mail.ReadMessage(bytes.NewReader(raw)); err != nil {
+		return "", fmt.Errorf("not a valid RFC 822 message: %v", err)
+	}
+	m, err := c.svc.Messages.Import("me", &gmail.Message{
+		Raw:      base64.URLEncoding.EncodeToString(raw),
+		LabelIds: labelIDs,
+	}).InternalDateSource("dateHeader").Do()
+	if err != nil {
+		return "", err
+	}
+	return m.Id, nil
+}
+
+// Watch asks Gmail to publish mailbox changes to the Cloud Pub/Sub
+// topic topicName ("projects/<project>/topics/<topic>"). The topic must
+// already exist and grant publish rights to
+// gmail-api-push@system.gserviceaccount.com. If labelIDs is non-empty,
+// only changes to messages with those labels are published.
+//
+// It returns the mailbox's current history ID and the time (in epoch
+// milliseconds) at which the watch expires; Watch must be called again
+// before then to keep receiving notifications.
+func (c *FewerClient) Watch(topicName string, labelIDs []string) (historyID uint64, expiration int64, err error) {
+	req := &gmail.WatchRequest{
+		TopicName: topicName,
+		LabelIds:  labelIDs,
+	}
+	if len(labelIDs) > 0 {
+		req.LabelFilterBehavior = "include"
+	}
+	res, err := c.svc.Watch("me", req).Do()
+	if err != nil {
+		return 0, 0, err
+	}
+	return res.HistoryId, res.Expiration, nil
+}
+
+// StopWatch stops push notifications set up by Watch.
+func (c *FewerClient) StopWatch() error {
+	return c.svc.Stop("me").Do()
+}
+
+// ThreadSummary is the triage-level metadata of a thread.
+type ThreadSummary struct {
+	ID           string
+	Subject      string   // from the first message
+	From         string   // sender of the first message
+	Participants []string // deduped From/To addresses, in order of appearance
+	MessageCount int
+	LastDate     time.Time // internal date of the last message
+	Unread       bool      // any message is unread
+	Labels       []string  // union of all messages' label IDs
+}
+
+// SummarizeThread fetches just the headers of the thread tid and
+// summarizes them.
+func (c *FewerClient) SummarizeThread(tid string) (ThreadSummary, error) {
+	t, err := c.svc.Threads.Get("me", tid).Format("metadata").
+		MetadataHeaders("From", "To", "Subject").Do()
+	if err != nil {
+		return ThreadSummary{}, err
+	}
+	return summarizeThread(t), nil
+}
+
+func summarizeThread(t *gmail.Thread) ThreadSummary {
+	s := ThreadSummary{
+		ID:           t.Id,
+		MessageCount: len(t.Messages),
+	}
+	seenAddr := map[string]bool{}
+	seenLabel := map[string]bool{}
+	for _, m := range t.Messages {
+		if s.Subject == "" {
+			s.Subject = headerValue(m, "Subject")
+		}
+		if s.From == "" {
+			s.From = headerValue(m, "From")
+		}
+		for _, h := range []string{"From", "To"} {
+			v := headerValue(m, h)
+			if v == "" {
+				continue
+			}
+			addrs, err := mail.ParseAddressList(v)
+			if err != nil {
+				addrs = []*mail.Address{{Address: v}}
+			}
+			for _, a := range addrs {
+				key := strings.ToLower(a.Address)
+				if seenAddr[key] {
+					continue
+				}
+				seenAddr[key] = true
+				s.Participants = append(s.Participants, a.String())
+			}
+		}
+		for _, l := range m.LabelIds {
+			if l == "UNREAD" {
+				s.Unread = true
+			}
+			if !seenLabel[l] {
+				seenLabel[l] = true
+				s.Labels = append(s.Labels, l)
+			}
+		}
+		if d := time.Unix(0, m.InternalDate*int64(time.Millisecond)); d.After(s.LastDate) {
+			s.LastDate = d
+		}
+	}
+	return s
+}
+
 func main() {
+	flag.Parse()
+	switch *archiveOn {
+	case "merged", "closed", "either":
+	default:
+		log.Fatalf("invalid -archive-on value %q; want merged, closed or either", *archiveOn)
+	}
+	// These change the mailbox or the cached token directly and have
+	// no dry-run mode.
+	if *dryRun && (*snooze != "" || *unsnooze != "" || *untrash != "" || *importFile != "" ||
+		*pubsubTopic != "" || *pubsubStop || *logout) {
+		log.Fatalf("-dry-run can't be combined with -snooze, -unsnooze, -untrash, -import, -pubsub-topic, -pubsub-stop or -logout")
+	}
+	if *watch && *interval <= 0 {
+		log.Fatalf("-interval must be positive")
+	}
+	var rules []*rule
+	if *rulesFile != "" {
+		var err error
+		if rules, err = loadRules(*rulesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	const OOB = "urn:ietf:wg:oauth:2.0:oob"
 	conf := &oauth2.Config{
 		ClientID: "881077086782-039l7vctubc7vrvjmubv6a7v0eg96sqg.apps.googleusercontent.com", // proj: inbox-fewer
@@ -111,10 +512,22 @@ func main() {
 	cacheDir := filepath.Join(userCacheDir(), "inboxfewer")
 	gmailTokenFile := filepath.Join(cacheDir, "gmail.token")
 
-	slurp, err := ioutil.ReadFile(gmailTokenFile)
+	if *logout {
+		if err := removeTokenFile(gmailTokenFile); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cached, err := readTokenFile(gmailTokenFile)
+	if err != nil && !os.IsNotExist(err) {
+		// Don't prompt for a new token and overwrite one that is
+		// only unreadable because of the wrong $INBOXFEWER_TOKEN_KEY.
+		log.Fatalf("Cached token unreadable: %v (check $%s, or use -logout to discard it)", err, tokenKeyEnv)
+	}
 	var ts oauth2.TokenSource
 	if err == nil {
-		f := strings.Fields(strings.TrimSpace(string(slurp)))
+		f := strings.Fields(cached)
 		if len(f) == 2 {
 			ts = conf.TokenSource(context.Background(), &oauth2.Token{
 				AccessToken:  f[0],
@@ -144,42 +557,295 @@ func main() {
 			log.Fatal(err)
 		}
 		os.MkdirAll(cacheDir, 0700)
-		ioutil.WriteFile(gmailTokenFile, []byte(t.AccessToken+" "+t.RefreshToken), 0600)
+		if err := writeTokenFile(gmailTokenFile, t.AccessToken+" "+t.RefreshToken); err != nil {
+			log.Printf("Caching token: %v", err)
+		}
 		ts = conf.TokenSource(context.Background(), t)
 	}
 
 	client := oauth2.NewClient(context.Background(), ts)
+	if *qps > 0 {
+		client.Transport = newRateLimitedTransport(client.Transport, *qps, *burst)
+	}
+	// Outside the rate limiter, so that retries are limited too.
+	client.Transport = newRetryTransport(client.Transport, *retries, time.Second)
 	svc, err := gmail.New(client)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	fc := &FewerClient{
+		svc:        svc.Users,
+		snoozeFile: filepath.Join(cacheDir, "snoozed.json"),
+	}
+	if *labelQuery != "" {
+		var labels []string
+		for _, name := range strings.Split(*labelNames, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				labels = append(labels, name)
+			}
+		}
+		if len(labels) == 0 {
+			log.Fatalf("-label-query requires -label")
+		}
+		n, err := fc.LabelAndArchive(*labelQuery, labels, *labelArchive, true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *dryRun {
+			log.Printf("Would label %d messages %q", n, labels)
+			return
+		}
+		if n > labelConfirmThreshold && !*yes {
+			log.Fatalf("%d messages match %q; rerun with -yes to label them all", n, *labelQuery)
+		}
+		if n, err = fc.LabelAndArchive(*labelQuery, labels, *labelArchive, false); err != nil {
+			log.Fatalf("Labeled %d messages, then: %v", n, err)
+		}
+		log.Printf("Labeled %d messages %q", n, labels)
+		return
+	}
+	if *rawMessage != "" {
+		raw, err := fc.GetRawMessage(*rawMessage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		file := filepath.Base(*rawMessage) + ".eml"
+		if err := ioutil.WriteFile(file, raw, 0600); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Wrote %v (%d bytes)", file, len(raw))
+		return
+	}
+	if *importFile != "" {
+		raw, err := ioutil.ReadFile(*importFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var names []string
+		for _, name := range strings.Split(*importLabels, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		labelIDs, err := fc.existingLabelIDs(names)
+		if err != nil {
+			log.Fatal(err)
+		}
+		id, err := fc.ImportMessage(raw, labelIDs)
+		if err != nil {
+			log.Fatalf("Importing %v: %v", *importFile, err)
+		}
+		log.Printf("Imported %v as message %v", *importFile, id)
+		return
+	}
+	if *pubsubTopic != "" {
+		var labelIDs []string
+		if *pubsubLabels != "" {
+			labelIDs = strings.Split(*pubsubLabels, ",")
+		}
+		historyID, expiration, err := fc.Watch(*pubsubTopic, labelIDs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("history ID %d; renew before %v\n", historyID, time.Unix(0, expiration*int64(time.Millisecond)).Format(time.RFC3339))
+		return
+	}
+	if *pubsubStop {
+		if err := fc.StopWatch(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *untrash != "" {
+		for _, tid := range strings.Split(*untrash, ",") {
+			if err := fc.UntrashThread(strings.TrimSpace(tid)); err != nil {
+				log.Fatalf("Untrashing thread %v: %v", tid, err)
+			}
+		}
+		return
+	}
+	if *snooze != "" {
+		until, err := time.Parse(time.RFC3339, *snoozeUntil)
+		if err != nil {
+			log.Fatalf("-snooze needs an RFC 3339 -until time: %v", err)
+		}
+		if err := fc.SnoozeThread(*snooze, until); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *unsnooze != "" {
+		for _, tid := range strings.Split(*unsnooze, ",") {
+			if err := fc.UnsnoozeThread(strings.TrimSpace(tid)); err != nil {
+				log.Fatalf("Unsnoozing thread %v: %v", tid, err)
+			}
+		}
+		return
+	}
+	if *listSnoozed {
+		m, err := fc.Snoozed()
+		if err != nil {
+			log.Fatal(err)
+		}
+		var tids []string
+		for tid := range m {
+			tids = append(tids, tid)
+		}
+		sort.Slice(tids, func(i, j int) bool { return m[tids[i]].Before(m[tids[j]]) })
+		for _, tid := range tids {
+			fmt.Printf("%v\t%v\n", tid, m[tid].Local().Format(time.RFC3339))
+		}
+		return
+	}
+
 	readGithubConfig()
+	readGitlabConfig()
 
-	fc := &FewerClient{
-		svc: svc.Users,
+	if !*watch {
+		if _, err := fc.Cleanup(rules, *dryRun); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	n := 0
-	if err := fc.ForeachThread("in:inbox", func(t *gmail.Thread) error {
-		if err := fc.PopulateThread(t); err != nil {
-			return err
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		log.Printf("Got %v; exiting after the current pass", <-sigc)
+		// Restore the default handling, so a second signal kills
+		// a pass that is taking too long.
+		signal.Stop(sigc)
+		cancel()
+	}()
+	// Jitter the first pass so that many instances started together
+	// don't all hit the APIs at once.
+	first := time.Duration(rand.Int63n(int64(time.Minute)))
+	runEvery(ctx, time.After, first, *interval, func() {
+		if _, err := fc.Cleanup(rules, *dryRun); err != nil {
+			log.Printf("Cleanup pass failed: %v", err)
 		}
-		topic := fc.ClassifyThread(t)
-		n++
-		log.Printf("Thread %d (%v) = %T %v", n, t.Id, topic, topic)
-		if topic == nil {
-			return nil
+	})
+}
+
+// runEvery calls fn after first, and then interval after each call
+// returns, until ctx is done. A call in progress is never interrupted.
+// The waiting is done with after, normally time.After.
+func runEvery(ctx context.Context, after func(time.Duration) <-chan time.Time, first, interval time.Duration, fn func()) {
+	wait := first
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-after(wait):
 		}
-		if stale, err := topic.IsStale(); err != nil {
+		fn()
+		wait = interval
+	}
+}
+
+// cleanupStats summarizes one cleanup pass.
+type cleanupStats struct {
+	Scanned  int // inbox threads classified
+	Archived int // threads archived, as stale or by a rule (or that would be, in a dry run)
+	Trashed  int // threads trashed by a rule
+	Labeled  int // threads labeled by a rule
+	Errors   int // threads that failed to be checked, archived or acted on
+}
+
+// Cleanup does one pass: it archives inbox threads whose issue, pull
+// request or review is done, then applies rules. Failures to check or
+// archive individual threads are logged and counted rather than
+// aborting the pass.
+func (c *FewerClient) Cleanup(rules []*rule, dryRun bool) (cleanupStats, error) {
+	var stats cleanupStats
+	// A bad snooze file shouldn't stop the rest of the pass.
+	if _, err := c.UnsnoozeDue(time.Now(), dryRun); err != nil {
+		log.Printf("Unsnoozing threads: %v", err)
+	}
+	stale, err := c.FindStaleThreads("in:inbox", &stats)
+	if err != nil {
+		return stats, err
+	}
+	for _, st := range stale {
+		if dryRun {
+			log.Printf("Would archive thread %v %q: %T %v is %s", st.ID, st.Subject, st.Topic, st.Topic, st.State)
+			stats.Archived++
+			continue
+		}
+		log.Printf("Archiving thread %v %q: %T %v is %s", st.ID, st.Subject, st.Topic, st.Topic, st.State)
+		if err := c.ArchiveThread(st.ID); err != nil {
+			log.Printf("Archiving thread %v: %v", st.ID, err)
+			stats.Errors++
+			continue
+		}
+		stats.Archived++
+	}
+	c.ApplyRules(rules, dryRun, &stats)
+	log.Printf("Cleanup pass: %d threads scanned, %d archived, %d trashed, %d labeled, %d errors",
+		stats.Scanned, stats.Archived, stats.Trashed, stats.Labeled, stats.Errors)
+	if githubRateRemaining != "" {
+		log.Printf("GitHub API quota remaining: %s", githubRateRemaining)
+	}
+	return stats, nil
+}
+
+// staleThread is a thread whose referenced issue, pull request or
+// code review is done.
+type staleThread struct {
+	ID      string
+	Subject string
+	Topic   threadType
+	State   string // Topic's state, as reported by IsStale
+}
+
+// FindStaleThreads classifies every thread matching q and returns the
+// stale ones, counting them in stats.Scanned. Threads whose staleness
+// can't be determined are logged, counted in stats.Errors and skipped.
+// It only reads; archiving is left to the caller.
+func (c *FewerClient) FindStaleThreads(q string, stats *cleanupStats) (stale []staleThread, err error) {
+	var cands []staleThread
+	if err := c.ForeachThread(q, func(t *gmail.Thread) error {
+		if err := c.PopulateThread(t); err != nil {
 			return err
-		} else if stale {
-			log.Printf("  ... archiving")
-			return fc.ArchiveThread(t.Id)
+		}
+		topic := c.ClassifyThread(t)
+		stats.Scanned++
+		log.Printf("Thread %d (%v) = %T %v %+v", stats.Scanned, t.Id, topic, topic, threadSignalsOf(t))
+		if topic != nil && len(t.Messages) > 0 {
+			cands = append(cands, staleThread{
+				ID:      t.Id,
+				Subject: headerValue(t.Messages[0], "Subject"),
+				Topic:   topic,
+			})
 		}
 		return nil
 	}); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+
+	cache := staleCache{}
+	var topics []threadType
+	for _, st := range cands {
+		topics = append(topics, st.Topic)
+	}
+	if err := cache.prefetchGithub(topics); err != nil {
+		log.Printf("Batch GitHub lookup failed, checking individually: %v", err)
+	}
+	for _, st := range cands {
+		ok, state, err := cache.IsStale(st.Topic)
+		if err != nil {
+			log.Printf("Checking thread %v (%T %v): %v", st.ID, st.Topic, st.Topic, err)
+			stats.Errors++
+			continue
+		}
+		if ok {
+			st.State = state
+			stale = append(stale, st)
+		}
+	}
+	return stale, nil
 }
 
 type message struct {
@@ -190,7 +856,157 @@ type message struct {
 }
 
 type threadType interface {
-	IsStale() (bool, error)
+	// IsStale reports whether the thread about the issue, pull
+	// request or review can be archived, and its state: "open",
+	// "merged", "closed unmerged", "closed" or "missing".
+	IsStale() (stale bool, state string, err error)
+}
+
+// staleResult is one IsStale result.
+type staleResult struct {
+	stale bool
+	state string
+}
+
+// staleCache memoizes IsStale results for the duration of a run, since
+// many threads typically reference the same issue or change.
+type staleCache map[threadType]staleResult
+
+func (sc staleCache) IsStale(topic threadType) (bool, string, error) {
+	if r, ok := sc[topic]; ok {
+		return r.stale, r.state, nil
+	}
+	stale, state, err := topic.IsStale()
+	if err != nil {
+		return false, "", err
+	}
+	sc[topic] = staleResult{stale, state}
+	return stale, state, nil
+}
+
+// apiClient is the HTTP client for the GitHub and GitLab APIs and for
+// revoking the Gmail token. Tests replace it.
+var apiClient = http.DefaultClient
+
+// githubGraphQLURL is the GitHub GraphQL API endpoint.
+var githubGraphQLURL = "https://api.github.com/graphql"
+
+// githubGraphQLBatch is the number of issues and pull requests looked
+// up per GraphQL query, well under GitHub's node limit.
+const githubGraphQLBatch = 100
+
+// prefetchGithub looks up all GitHub issues and pull requests in topics
+// that aren't cached yet, using one GraphQL query per batch instead of
+// one REST request each.
+func (sc staleCache) prefetchGithub(topics []threadType) error {
+	var refs []threadType
+	seen := map[threadType]bool{}
+	for _, t := range topics {
+		switch t.(type) {
+		case githubIssue, githubPull:
+			if _, ok := sc[t]; !ok && !seen[t] {
+				seen[t] = true
+				refs = append(refs, t)
+			}
+		}
+	}
+	for len(refs) > 0 {
+		chunk := refs
+		if len(chunk) > githubGraphQLBatch {
+			chunk = chunk[:githubGraphQLBatch]
+		}
+		refs = refs[len(chunk):]
+		res, err := githubBatchIsStale(chunk)
+		if err != nil {
+			return err
+		}
+		for t, r := range res {
+			sc[t] = r
+		}
+	}
+	return nil
+}
+
+// githubBatchIsStale reports the staleness of each githubIssue or
+// githubPull in refs with a single GraphQL query. Like the REST
+// checks, references that no longer exist are considered stale.
+func githubBatchIsStale(refs []threadType) (map[threadType]staleResult, error) {
+	var q bytes.Buffer
+	q.WriteString("query {")
+	for i, ref := range refs {
+		var repo, n string
+		switch ref := ref.(type) {
+		case githubIssue:
+			repo, n = ref.repo, ref.n
+		case githubPull:
+			repo, n = ref.repo, ref.n
+		default:
+			return nil, fmt.Errorf("unexpected GitHub reference type %T", ref)
+		}
+		owner, name := repo[:strings.Index(repo, "/")], repo[strings.Index(repo, "/")+1:]
+		fmt.Fprintf(&q, " r%d: repository(owner: %q, name: %q) { issueOrPullRequest(number: %s) {"+
+			" ... on Issue { state } ... on PullRequest { state } } }", i, owner, name, n)
+	}
+	q.WriteString(" }")
+
+	body, err := json.Marshal(map[string]string{"query": q.String()})
+	if err != nil {
+		return nil, err
+	}
+	req, _ := http.NewRequest("POST", githubGraphQLURL, bytes.NewReader(body))
+	req.SetBasicAuth(githubUser, githubToken)
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	noteGithubRateLimit(res)
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("GitHub GraphQL query, http status %s", res.Status)
+	}
+	var resp struct {
+		Data map[string]*struct {
+			IssueOrPullRequest *struct {
+				State string `json:"state"` // "OPEN", "CLOSED", "MERGED"
+			} `json:"issueOrPullRequest"`
+		} `json:"data"`
+		Errors []struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	for _, e := range resp.Errors {
+		if e.Type != "NOT_FOUND" {
+			return nil, fmt.Errorf("GitHub GraphQL query: %s", e.Message)
+		}
+	}
+	if resp.Data == nil {
+		return nil, fmt.Errorf("GitHub GraphQL query returned no data")
+	}
+	results := make(map[threadType]staleResult, len(refs))
+	for i, ref := range refs {
+		node := resp.Data[fmt.Sprintf("r%d", i)]
+		if node == nil || node.IssueOrPullRequest == nil {
+			results[ref] = staleResult{true, "missing"} // NOT_FOUND
+			continue
+		}
+		switch node.IssueOrPullRequest.State {
+		case "OPEN":
+			results[ref] = prResult(prOpen)
+		case "MERGED":
+			results[ref] = prResult(prMerged)
+		default:
+			if _, ok := ref.(githubPull); ok {
+				results[ref] = prResult(prClosedUnmerged)
+			} else {
+				results[ref] = staleResult{true, "closed"}
+			}
+		}
+	}
+	return results, nil
 }
 
 type gerritChange struct {
@@ -198,17 +1014,26 @@ type gerritChange struct {
 	Server string // "go-review.googlesource.com"
 }
 
-func (gc gerritChange) IsStale() (bool, error) {
+func (gc gerritChange) IsStale() (bool, string, error) {
 	c := gerrit.NewClient("https://"+gc.Server, gerrit.NoAuth)
 	ci, err := c.GetChangeDetail(gc.ID)
 	if err != nil {
-		return false, err
+		return false, "", err
 	}
-	switch ci.Status {
-	case "SUBMITTED", "MERGED", "ABANDONED":
-		return true, nil
+	r := prResult(gerritState(ci.Status))
+	return r.stale, r.state, nil
+}
+
+// gerritState maps a change's status to the equivalent pull request
+// state; an abandoned change counts as closed without merging.
+func gerritState(status string) prState {
+	switch status {
+	case "SUBMITTED", "MERGED":
+		return prMerged
+	case "ABANDONED":
+		return prClosedUnmerged
 	}
-	return false, nil
+	return prOpen
 }
 
 type githubIssue struct {
@@ -216,28 +1041,29 @@ type githubIssue struct {
 	n    string // "123"
 }
 
-func (id githubIssue) IsStale() (bool, error) {
+func (id githubIssue) IsStale() (bool, string, error) {
 	issueURL := "https://api.github.com/repos/" + id.repo + "/issues/" + id.n
 	req, _ := http.NewRequest("GET", issueURL, nil)
 	req.SetBasicAuth(githubUser, githubToken)
-	res, err := http.DefaultClient.Do(req)
+	res, err := apiClient.Do(req)
 	if err != nil {
-		return false, nil
+		return false, "", nil
 	}
 	defer res.Body.Close()
+	noteGithubRateLimit(res)
 	if res.StatusCode == 404 {
-		return true, nil
+		return true, "missing", nil
 	}
 	if res.StatusCode != 200 {
-		return false, fmt.Errorf("fetching %v, http status %s", issueURL, res.Status)
+		return false, "", fmt.Errorf("fetching %v, http status %s", issueURL, res.Status)
 	}
 	var issue struct {
 		State string `json:"state"`
 	}
 	if err := json.NewDecoder(res.Body).Decode(&issue); err != nil {
-		return false, err
+		return false, "", err
 	}
-	return issue.State == "closed", nil
+	return issue.State == "closed", issue.State, nil
 }
 
 type githubPull struct {
@@ -245,28 +1071,138 @@ type githubPull struct {
 	n    string // "123"
 }
 
-func (id githubPull) IsStale() (bool, error) {
+func (id githubPull) IsStale() (bool, string, error) {
 	pullURL := "https://api.github.com/repos/" + id.repo + "/pulls/" + id.n
 	req, _ := http.NewRequest("GET", pullURL, nil)
 	req.SetBasicAuth(githubUser, githubToken)
-	res, err := http.DefaultClient.Do(req)
+	res, err := apiClient.Do(req)
 	if err != nil {
-		return false, nil
+		return false, "", nil
 	}
 	defer res.Body.Close()
+	noteGithubRateLimit(res)
 	if res.StatusCode == 404 {
-		return true, nil
+		return true, "missing", nil
 	}
 	if res.StatusCode != 200 {
-		return false, fmt.Errorf("fetching %v, http status %s", pullURL, res.Status)
+		return false, "", fmt.Errorf("fetching %v, http status %s", pullURL, res.Status)
 	}
 	var pull struct {
-		State string `json:"state"`
+		State  string `json:"state"`
+		Merged bool   `json:"merged"`
 	}
 	if err := json.NewDecoder(res.Body).Decode(&pull); err != nil {
-		return false, err
+		return false, "", err
+	}
+	st := prOpen
+	switch {
+	case pull.Merged:
+		st = prMerged
+	case pull.State == "closed":
+		st = prClosedUnmerged
+	}
+	r := prResult(st)
+	return r.stale, r.state, nil
+}
+
+// prState is the state of a pull request, merge request or code
+// review.
+type prState int
+
+const (
+	prOpen prState = iota
+	prMerged
+	prClosedUnmerged
+)
+
+func (st prState) String() string {
+	switch st {
+	case prMerged:
+		return "merged"
+	case prClosedUnmerged:
+		return "closed unmerged"
+	}
+	return "open"
+}
+
+// prResult returns the IsStale result for a pull request in state st.
+func prResult(st prState) staleResult {
+	return staleResult{pullStale(st), st.String()}
+}
+
+// pullStale reports whether a pull request in state st is stale
+// according to the -archive-on policy.
+func pullStale(st prState) bool {
+	switch st {
+	case prMerged:
+		return *archiveOn != "closed"
+	case prClosedUnmerged:
+		return *archiveOn != "merged"
+	}
+	return false
+}
+
+type gitlabItem struct {
+	server  string // "gitlab.com"
+	project string // "gitlab-org/gitlab"
+	kind    string // "issues" or "merge_requests"
+	iid     string // "123"
+}
+
+func (id gitlabItem) IsStale() (bool, string, error) {
+	itemURL := "https://" + id.server + "/api/v4/projects/" + url.PathEscape(id.project) + "/" + id.kind + "/" + id.iid
+	req, _ := http.NewRequest("GET", itemURL, nil)
+	// The server comes from the email, so never send the token
+	// anywhere but the configured host.
+	authed := gitlabToken != "" && id.server == gitlabHost
+	if authed {
+		req.Header.Set("PRIVATE-TOKEN", gitlabToken)
+	}
+	res, err := apiClient.Do(req)
+	if err != nil {
+		return false, "", nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		// Without a token, private projects look missing too, so
+		// only a token holder can tell that the item is gone.
+		return authed, "missing", nil
+	}
+	if res.StatusCode != 200 {
+		return false, "", fmt.Errorf("fetching %v, http status %s", itemURL, res.Status)
+	}
+	var item struct {
+		State string `json:"state"` // "opened", "closed", "merged", "locked"
+	}
+	if err := json.NewDecoder(res.Body).Decode(&item); err != nil {
+		return false, "", err
+	}
+	var r staleResult
+	switch {
+	case item.State == "merged":
+		r = prResult(prMerged)
+	case item.State == "closed" && id.kind == "merge_requests":
+		r = prResult(prClosedUnmerged)
+	case item.State == "closed":
+		r = staleResult{true, "closed"}
+	default:
+		r = staleResult{false, "open"}
+	}
+	return r.stale, r.state, nil
+}
+
+// githubRateRemaining is the most recently seen X-RateLimit-Remaining
+// value from the GitHub API.
+var githubRateRemaining string
+
+func noteGithubRateLimit(res *http.Response) {
+	if v := res.Header.Get("X-RateLimit-Remaining"); v != "" {
+		githubRateRemaining = v
+	}
+	if res.StatusCode == 403 && githubRateRemaining == "0" {
+		reset, _ := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+		log.Printf("GitHub API rate limit exhausted; resets at %v", time.Unix(reset, 0))
 	}
-	return pull.State == "closed", nil
 }
 
 var githubIssueID = regexp.MustCompile(`^<([\w-]+/[\w-]+)/issues?/(\d+).*@github\.com>$`)
@@ -288,6 +1224,32 @@ func (c *FewerClient) ClassifyThread(t *gmail.Thread) threadType {
 					Server: v,
 				}
 			}
+			if mph.Name == "X-GitLab-Issue-IID" || mph.Name == "X-GitLab-MergeRequest-IID" {
+				kind := "issues"
+				if mph.Name == "X-GitLab-MergeRequest-IID" {
+					kind = "merge_requests"
+				}
+				// <issue_123456@gitlab.com>, or the self-hosted domain.
+				server := "gitlab.com"
+				if v := headerValue(m, "Message-ID"); strings.Contains(v, "@") {
+					server = strings.TrimSuffix(v[strings.LastIndex(v, "@")+1:], ">")
+				}
+				// Anyone can send mail with these headers; only
+				// trust the configured server's answer.
+				if server != gitlabHost {
+					return nil
+				}
+				project := headerValue(m, "X-GitLab-Project-Path") // "gitlab-org/gitlab"
+				if project == "" {
+					return nil
+				}
+				return gitlabItem{
+					server:  server,
+					project: project,
+					kind:    kind,
+					iid:     mph.Value,
+				}
+			}
 			// <golang/go/issue/3665/100642466@github.com>
 			if mph.Name == "Message-ID" &&
 				(strings.Contains(mph.Value, "/issues/") || strings.Contains(mph.Value, "/issue/")) &&
@@ -310,6 +1272,37 @@ func (c *FewerClient) ClassifyThread(t *gmail.Thread) threadType {
 	return nil
 }
 
+// threadSignals are the Gmail-assigned hints about a thread, reported
+// alongside the github/gerrit classification.
+type threadSignals struct {
+	Categories   []string // "CATEGORY_UPDATES", etc.
+	Important    bool     // has the IMPORTANT label
+	Notification bool     // mailing list or bulk mail
+}
+
+// threadSignalsOf returns the category labels, importance and whether t
+// looks like an automated notification (List-Id or "Precedence: bulk").
+func threadSignalsOf(t *gmail.Thread) threadSignals {
+	var s threadSignals
+	seen := map[string]bool{}
+	for _, m := range t.Messages {
+		for _, l := range m.LabelIds {
+			switch {
+			case l == "IMPORTANT":
+				s.Important = true
+			case strings.HasPrefix(l, "CATEGORY_") && !seen[l]:
+				seen[l] = true
+				s.Categories = append(s.Categories, l)
+			}
+		}
+		if headerValue(m, "List-Id") != "" ||
+			strings.EqualFold(headerValue(m, "Precedence"), "bulk") {
+			s.Notification = true
+		}
+	}
+	return s
+}
+
 func headerValue(m *gmail.Message, header string) string {
 	mpart := m.Payload
 	if mpart == nil {
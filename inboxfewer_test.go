@@ -0,0 +1,716 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file:
+// https://golang.org/LICENSE
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// newTestClient returns a FewerClient whose Gmail API requests are
+// served by h.
+func newTestClient(t *testing.T, h http.Handler) *FewerClient {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	svc, err := gmail.New(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.BasePath = srv.URL + "/"
+	return &FewerClient{svc: svc.Users}
+}
+
+// recordRequests returns a handler that appends "METHOD path" for each
+// request to *got and replies with an empty JSON object.
+func recordRequests(got *[]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*got = append(*got, r.Method+" "+r.URL.Path)
+		fmt.Fprint(w, "{}")
+	})
+}
+
+func TestTrashUntrashThread(t *testing.T) {
+	tests := []struct {
+		name string
+		do   func(c *FewerClient, tid string) error
+		want string
+	}{
+		{"archive", (*FewerClient).ArchiveThread, "POST /gmail/v1/users/me/threads/t1/modify"},
+		{"trash", (*FewerClient).TrashThread, "POST /gmail/v1/users/me/threads/t1/trash"},
+		{"untrash", (*FewerClient).UntrashThread, "POST /gmail/v1/users/me/threads/t1/untrash"},
+	}
+	for _, tt := range tests {
+		var got []string
+		c := newTestClient(t, recordRequests(&got))
+		if err := tt.do(c, "t1"); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s: requests = %q; want [%q]", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLabelAndArchive(t *testing.T) {
+	const total = 2300 // more than two batches
+	for _, dryRun := range []bool{false, true} {
+		var batches []string
+		created := false
+		c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == "GET" && r.URL.Path == "/gmail/v1/users/me/labels":
+				fmt.Fprint(w, `{"labels": [{"id": "Label_1", "name": "Shopping"}]}`)
+			case r.Method == "POST" && r.URL.Path == "/gmail/v1/users/me/labels":
+				created = true
+				fmt.Fprint(w, `{"id": "Label_2", "name": "Receipts"}`)
+			case r.Method == "GET" && r.URL.Path == "/gmail/v1/users/me/messages":
+				if q := r.URL.Query().Get("q"); q != "from:shop" {
+					t.Errorf("query = %q; want %q", q, "from:shop")
+				}
+				// Pages of 500 messages, with the offset as page token.
+				start, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+				var res gmail.ListMessagesResponse
+				for i := start; i < total && i < start+500; i++ {
+					res.Messages = append(res.Messages, &gmail.Message{Id: fmt.Sprint("m", i)})
+				}
+				if start+500 < total {
+					res.NextPageToken = fmt.Sprint(start + 500)
+				}
+				json.NewEncoder(w).Encode(&res)
+			case r.Method == "POST" && r.URL.Path == "/gmail/v1/users/me/messages/batchModify":
+				var req gmail.BatchModifyMessagesRequest
+				json.NewDecoder(r.Body).Decode(&req)
+				batches = append(batches, fmt.Sprintf("%s..%s +%v -%v", req.Ids[0], req.Ids[len(req.Ids)-1], req.AddLabelIds, req.RemoveLabelIds))
+			default:
+				t.Errorf("unexpected request %v %v", r.Method, r.URL.Path)
+				http.NotFound(w, r)
+			}
+		}))
+		n, err := c.LabelAndArchive("from:shop", []string{"Shopping", "Receipts"}, true, dryRun)
+		if err != nil {
+			t.Fatalf("dryRun=%v: %v", dryRun, err)
+		}
+		if n != total {
+			t.Errorf("dryRun=%v: matched %d messages; want %d", dryRun, n, total)
+		}
+		var want []string
+		if !dryRun {
+			want = []string{
+				"m0..m999 +[Label_1 Label_2] -[INBOX]",
+				"m1000..m1999 +[Label_1 Label_2] -[INBOX]",
+				"m2000..m2299 +[Label_1 Label_2] -[INBOX]",
+			}
+		}
+		if !reflect.DeepEqual(batches, want) {
+			t.Errorf("dryRun=%v: batches %q; want %q", dryRun, batches, want)
+		}
+		if created == dryRun {
+			t.Errorf("dryRun=%v: label created = %v", dryRun, created)
+		}
+	}
+}
+
+// testMessage returns a message with the given labels, internal date
+// (in epoch milliseconds) and alternating header names and values.
+func testMessage(labels []string, date int64, headers ...string) *gmail.Message {
+	m := &gmail.Message{LabelIds: labels, InternalDate: date, Payload: &gmail.MessagePart{}}
+	for i := 0; i+1 < len(headers); i += 2 {
+		m.Payload.Headers = append(m.Payload.Headers, &gmail.MessagePartHeader{Name: headers[i], Value: headers[i+1]})
+	}
+	return m
+}
+
+func TestSummarizeThread(t *testing.T) {
+	th := &gmail.Thread{
+		Id: "t1",
+		Messages: []*gmail.Message{
+			testMessage([]string{"INBOX"}, 1000,
+				"Subject", "Lunch?", "From", "Alice <alice@example.com>", "To", "bob@example.com"),
+			testMessage([]string{"INBOX", "UNREAD"}, 3000,
+				"Subject", "Re: Lunch?", "From", "Bob <BOB@example.com>", "To", "alice@example.com, Carol <carol@example.com>"),
+			testMessage([]string{"INBOX", "IMPORTANT"}, 2000,
+				"From", "alice@example.com", "To", "bob@example.com"),
+		},
+	}
+	got := summarizeThread(th)
+	want := ThreadSummary{
+		ID:      "t1",
+		Subject: "Lunch?",
+		From:    "Alice <alice@example.com>",
+		Participants: []string{
+			`"Alice" <alice@example.com>`,
+			"<bob@example.com>",
+			`"Carol" <carol@example.com>`,
+		},
+		MessageCount: 3,
+		LastDate:     time.Unix(3, 0),
+		Unread:       true,
+		Labels:       []string{"INBOX", "UNREAD", "IMPORTANT"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summarizeThread =\n%+v\nwant\n%+v", got, want)
+	}
+
+	th.Messages[1].LabelIds = []string{"INBOX"}
+	if summarizeThread(th).Unread {
+		t.Errorf("Unread = true with no UNREAD messages")
+	}
+}
+
+func TestGetRawMessage(t *testing.T) {
+	defer func(old int64) { *maxRawMessageSize = old }(*maxRawMessageSize)
+	const raw = "Subject: hi\r\n\r\nhello\r\n"
+	var formats []string
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gmail/v1/users/me/messages/m1" {
+			t.Errorf("unexpected request %v %v", r.Method, r.URL.Path)
+		}
+		format := r.URL.Query().Get("format")
+		formats = append(formats, format)
+		m := gmail.Message{Id: "m1", SizeEstimate: int64(len(raw))}
+		if format == "raw" {
+			m.Raw = base64.URLEncoding.EncodeToString([]byte(raw))
+		}
+		json.NewEncoder(w).Encode(m)
+	}))
+
+	*maxRawMessageSize = int64(len(raw))
+	got, err := c.GetRawMessage("m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != raw {
+		t.Errorf("GetRawMessage = %q; want %q", got, raw)
+	}
+	if want := []string{"minimal", "raw"}; !reflect.DeepEqual(formats, want) {
+		t.Errorf("fetched formats %q; want %q", formats, want)
+	}
+
+	formats = nil
+	*maxRawMessageSize = int64(len(raw)) - 1
+	if _, err := c.GetRawMessage("m1"); err == nil {
+		t.Errorf("GetRawMessage of oversized message succeeded")
+	}
+	if want := []string{"minimal"}; !reflect.DeepEqual(formats, want) {
+		t.Errorf("oversized message: fetched formats %q; want %q", formats, want)
+	}
+}
+
+func TestThreadSignals(t *testing.T) {
+	tests := []struct {
+		name string
+		msgs []*gmail.Message
+		want threadSignals
+	}{
+		{
+			name: "personal",
+			msgs: []*gmail.Message{testMessage([]string{"INBOX"}, 0, "From", "a@example.com")},
+			want: threadSignals{},
+		},
+		{
+			name: "list",
+			msgs: []*gmail.Message{testMessage(nil, 0, "List-Id", "<golang-dev.googlegroups.com>")},
+			want: threadSignals{Notification: true},
+		},
+		{
+			name: "bulk",
+			msgs: []*gmail.Message{testMessage(nil, 0, "Precedence", "Bulk")},
+			want: threadSignals{Notification: true},
+		},
+		{
+			name: "categories",
+			msgs: []*gmail.Message{
+				testMessage([]string{"INBOX", "CATEGORY_UPDATES"}, 0),
+				testMessage([]string{"CATEGORY_UPDATES", "IMPORTANT", "CATEGORY_FORUMS"}, 0),
+			},
+			want: threadSignals{
+				Categories: []string{"CATEGORY_UPDATES", "CATEGORY_FORUMS"},
+				Important:  true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		got := threadSignalsOf(&gmail.Thread{Messages: tt.msgs})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: threadSignalsOf = %+v; want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// withAPIServer points apiClient at a TLS test server running h for the
+// duration of the test and returns the server's host:port.
+func withAPIServer(t *testing.T, h http.Handler) string {
+	srv := httptest.NewTLSServer(h)
+	old := apiClient
+	apiClient = srv.Client()
+	t.Cleanup(func() {
+		apiClient = old
+		srv.Close()
+	})
+	return strings.TrimPrefix(srv.URL, "https://")
+}
+
+// withGitlab sets the GitLab host and token for the duration of the
+// test.
+func withGitlab(t *testing.T, host, token string) {
+	oldHost, oldToken := gitlabHost, gitlabToken
+	gitlabHost, gitlabToken = host, token
+	t.Cleanup(func() { gitlabHost, gitlabToken = oldHost, oldToken })
+}
+
+func TestGitlabItemIsStale(t *testing.T) {
+	// Recorded (trimmed) responses from the GitLab v4 API.
+	server := withAPIServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.RequestURI {
+		case "/api/v4/projects/group%2Fproj/issues/1":
+			fmt.Fprint(w, `{"id": 101, "iid": 1, "project_id": 7, "title": "Open issue", "state": "opened"}`)
+		case "/api/v4/projects/group%2Fproj/issues/2":
+			fmt.Fprint(w, `{"id": 102, "iid": 2, "project_id": 7, "title": "Closed issue", "state": "closed"}`)
+		case "/api/v4/projects/group%2Fproj/merge_requests/3":
+			fmt.Fprint(w, `{"id": 103, "iid": 3, "project_id": 7, "title": "Merged MR", "state": "merged"}`)
+		default:
+			w.WriteHeader(404)
+			fmt.Fprint(w, `{"message": "404 Not found"}`)
+		}
+	}))
+	tests := []struct {
+		kind, iid string
+		token     string
+		want      bool
+		wantState string
+	}{
+		{"issues", "1", "", false, "open"},
+		{"issues", "2", "", true, "closed"},
+		{"merge_requests", "3", "", true, "merged"},
+		{"issues", "4", "", false, "missing"}, // or private, without a token
+		{"issues", "4", "secret", true, "missing"},
+	}
+	for _, tt := range tests {
+		withGitlab(t, server, tt.token)
+		id := gitlabItem{server: server, project: "group/proj", kind: tt.kind, iid: tt.iid}
+		got, state, err := id.IsStale()
+		if err != nil {
+			t.Errorf("%s %s (token %q): %v", tt.kind, tt.iid, tt.token, err)
+			continue
+		}
+		if got != tt.want || state != tt.wantState {
+			t.Errorf("%s %s (token %q): IsStale = %v, %q; want %v, %q", tt.kind, tt.iid, tt.token, got, state, tt.want, tt.wantState)
+		}
+	}
+}
+
+func TestClassifyGitlabThread(t *testing.T) {
+	withGitlab(t, "gitlab.example.com", "")
+	var c FewerClient
+	th := &gmail.Thread{Messages: []*gmail.Message{testMessage(nil, 0,
+		"Message-ID", "<merge_request_123@gitlab.example.com>",
+		"X-GitLab-Project-Path", "group/proj",
+		"X-GitLab-MergeRequest-IID", "5",
+	)}}
+	want := gitlabItem{server: "gitlab.example.com", project: "group/proj", kind: "merge_requests", iid: "5"}
+	if got := c.ClassifyThread(th); got != want {
+		t.Errorf("ClassifyThread = %#v; want %#v", got, want)
+	}
+
+	th = &gmail.Thread{Messages: []*gmail.Message{testMessage(nil, 0,
+		"Message-ID", "<issue_123@gitlab.example.com>",
+		"X-GitLab-Issue-IID", "5",
+	)}}
+	if got := c.ClassifyThread(th); got != nil {
+		t.Errorf("ClassifyThread without project path = %#v; want nil", got)
+	}
+}
+
+func TestGitlabTokenStaysHome(t *testing.T) {
+	var tokens []string
+	server := withAPIServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("PRIVATE-TOKEN"))
+		fmt.Fprint(w, `{"state": "closed"}`)
+	}))
+	withGitlab(t, "gitlab.example.com", "secret")
+
+	// A forged notification pointing at another server isn't checked.
+	var c FewerClient
+	th := &gmail.Thread{Messages: []*gmail.Message{testMessage(nil, 0,
+		"Message-ID", "<issue_1@"+server+">",
+		"X-GitLab-Project-Path", "group/proj",
+		"X-GitLab-Issue-IID", "1",
+	)}}
+	if got := c.ClassifyThread(th); got != nil {
+		t.Errorf("ClassifyThread of foreign GitLab host = %#v; want nil", got)
+	}
+
+	// Nor is the token sent there if such an item is checked anyway.
+	if _, _, err := (gitlabItem{server: server, project: "group/proj", kind: "issues", iid: "1"}).IsStale(); err != nil {
+		t.Fatal(err)
+	}
+	gitlabHost = server
+	if _, _, err := (gitlabItem{server: server, project: "group/proj", kind: "issues", iid: "1"}).IsStale(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"", "secret"}; !reflect.DeepEqual(tokens, want) {
+		t.Errorf("PRIVATE-TOKEN headers sent = %q; want %q", tokens, want)
+	}
+}
+
+// countingTopic is a threadType that counts its IsStale calls.
+type countingTopic struct {
+	name  string
+	stale bool
+	calls *int
+}
+
+func (ct countingTopic) IsStale() (bool, string, error) {
+	*ct.calls++
+	return ct.stale, ct.name, nil
+}
+
+func TestStaleCache(t *testing.T) {
+	var calls int
+	a := countingTopic{"a", true, &calls}
+	b := countingTopic{"b", false, &calls}
+	cache := staleCache{}
+	for _, topic := range []threadType{a, b, a, a, b} {
+		got, state, err := cache.IsStale(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct := topic.(countingTopic)
+		if got != ct.stale || state != ct.name {
+			t.Errorf("IsStale(%s) = %v, %q; want %v, %q", ct.name, got, state, ct.stale, ct.name)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("IsStale called %d times for 2 distinct topics; want 2", calls)
+	}
+}
+
+func TestGithubBatchIsStale(t *testing.T) {
+	server := withAPIServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Query string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decoding query: %v", err)
+		}
+		for _, want := range []string{
+			`r0: repository(owner: "golang", name: "go") { issueOrPullRequest(number: 1)`,
+			`r3: repository(owner: "golang", name: "net") { issueOrPullRequest(number: 4)`,
+		} {
+			if !strings.Contains(req.Query, want) {
+				t.Errorf("query %q lacks %q", req.Query, want)
+			}
+		}
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		// Recorded response; r2 refers to a deleted issue.
+		fmt.Fprint(w, `{
+  "data": {
+    "r0": {"issueOrPullRequest": {"state": "OPEN"}},
+    "r1": {"issueOrPullRequest": {"state": "CLOSED"}},
+    "r2": {"issueOrPullRequest": null},
+    "r3": {"issueOrPullRequest": {"state": "MERGED"}}
+  },
+  "errors": [
+    {
+      "type": "NOT_FOUND",
+      "path": ["r2", "issueOrPullRequest"],
+      "locations": [{"line": 1, "column": 220}],
+      "message": "Could not resolve to an issue or pull request with the number of 3."
+    }
+  ]
+}`)
+	}))
+	defer func(old string) { githubGraphQLURL = old }(githubGraphQLURL)
+	githubGraphQLURL = "https://" + server + "/graphql"
+
+	open := githubIssue{repo: "golang/go", n: "1"}
+	closed := githubPull{repo: "golang/go", n: "2"}
+	missing := githubIssue{repo: "golang/go", n: "3"}
+	merged := githubPull{repo: "golang/net", n: "4"}
+	got, err := githubBatchIsStale([]threadType{open, closed, missing, merged})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[threadType]staleResult{
+		open:    {false, "open"},
+		closed:  {true, "closed unmerged"},
+		missing: {true, "missing"},
+		merged:  {true, "merged"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("githubBatchIsStale = %v; want %v", got, want)
+	}
+	if githubRateRemaining != "4999" {
+		t.Errorf("githubRateRemaining = %q; want 4999", githubRateRemaining)
+	}
+}
+
+func TestPullStale(t *testing.T) {
+	defer func(old string) { *archiveOn = old }(*archiveOn)
+	tests := []struct {
+		archiveOn string
+		st        prState
+		want      bool
+	}{
+		{"either", prOpen, false},
+		{"either", prMerged, true},
+		{"either", prClosedUnmerged, true},
+		{"merged", prOpen, false},
+		{"merged", prMerged, true},
+		{"merged", prClosedUnmerged, false},
+		{"closed", prOpen, false},
+		{"closed", prMerged, false},
+		{"closed", prClosedUnmerged, true},
+	}
+	for _, tt := range tests {
+		*archiveOn = tt.archiveOn
+		if got := pullStale(tt.st); got != tt.want {
+			t.Errorf("-archive-on=%s: pullStale(%d) = %v; want %v", tt.archiveOn, tt.st, got, tt.want)
+		}
+	}
+}
+
+func TestCleanupDecisions(t *testing.T) {
+	server := withAPIServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path.Base(r.URL.Path) {
+		case "1":
+			fmt.Fprint(w, `{"iid": 1, "state": "opened"}`)
+		case "2":
+			fmt.Fprint(w, `{"iid": 2, "state": "closed"}`)
+		default:
+			http.Error(w, "boom", 500)
+		}
+	}))
+	withGitlab(t, server, "")
+	// Inbox threads: "open" and "closed" refer to GitLab issues 1 and
+	// 2, "broken" to issue 3, whose lookup fails, and "plain" to
+	// nothing.
+	threads := map[string]*gmail.Thread{
+		"open":   {Id: "open", Messages: []*gmail.Message{gitlabIssueMessage(server, "1")}},
+		"closed": {Id: "closed", Messages: []*gmail.Message{gitlabIssueMessage(server, "2")}},
+		"broken": {Id: "broken", Messages: []*gmail.Message{gitlabIssueMessage(server, "3")}},
+		"plain":  {Id: "plain", Messages: []*gmail.Message{testMessage(nil, 0, "Subject", "hi")}},
+	}
+	for _, dryRun := range []bool{true, false} {
+		var modified []string
+		c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			const prefix = "/gmail/v1/users/me/threads"
+			switch {
+			case r.Method == "GET" && r.URL.Path == prefix:
+				fmt.Fprint(w, `{"threads": [{"id": "open"}, {"id": "closed"}, {"id": "broken"}, {"id": "plain"}]}`)
+			case r.Method == "GET" && strings.HasPrefix(r.URL.Path, prefix+"/"):
+				json.NewEncoder(w).Encode(threads[path.Base(r.URL.Path)])
+			case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/modify"):
+				modified = append(modified, path.Base(path.Dir(r.URL.Path)))
+				fmt.Fprint(w, "{}")
+			default:
+				t.Errorf("unexpected request %v %v", r.Method, r.URL.Path)
+				http.NotFound(w, r)
+			}
+		}))
+		c.snoozeFile = filepath.Join(t.TempDir(), "snoozed.json")
+		var logBuf bytes.Buffer
+		log.SetOutput(&logBuf)
+		stats, err := c.Cleanup(nil, dryRun)
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			t.Fatalf("dryRun=%v: %v", dryRun, err)
+		}
+		if want := `Would archive thread closed "Issue 2": main.gitlabItem {` + server + ` group/proj issues 2} is closed`; dryRun && !strings.Contains(logBuf.String(), want) {
+			t.Errorf("dry run log lacks %q:\n%s", want, logBuf.Bytes())
+		}
+		if want := (cleanupStats{Scanned: 4, Archived: 1, Errors: 1}); stats != want {
+			t.Errorf("dryRun=%v: stats = %+v; want %+v", dryRun, stats, want)
+		}
+		var want []string
+		if !dryRun {
+			want = []string{"closed"}
+		}
+		if !reflect.DeepEqual(modified, want) {
+			t.Errorf("dryRun=%v: modified threads %q; want %q", dryRun, modified, want)
+		}
+	}
+}
+
+// gitlabIssueMessage returns a GitLab notification about issue iid of
+// group/proj on server.
+func gitlabIssueMessage(server, iid string) *gmail.Message {
+	return testMessage(nil, 0,
+		"Subject", "Issue "+iid,
+		"Message-ID", "<issue_"+iid+"@"+server+">",
+		"X-GitLab-Project-Path", "group/proj",
+		"X-GitLab-Issue-IID", iid,
+	)
+}
+
+func TestRunEvery(t *testing.T) {
+	// The fake clock hands each requested wait to the test, which
+	// fires it by sending on the returned channel.
+	type wait struct {
+		d time.Duration
+		c chan time.Time
+	}
+	waits := make(chan wait)
+	after := func(d time.Duration) <-chan time.Time {
+		c := make(chan time.Time)
+		waits <- wait{d, c}
+		return c
+	}
+	calls := make(chan bool)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		runEvery(ctx, after, time.Second, time.Hour, func() { calls <- true })
+		close(done)
+	}()
+
+	for i, want := range []time.Duration{time.Second, time.Hour, time.Hour} {
+		w := <-waits
+		if w.d != want {
+			t.Errorf("wait %d = %v; want %v", i, w.d, want)
+		}
+		w.c <- time.Time{}
+		<-calls
+	}
+	<-waits
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runEvery didn't return after cancel")
+	}
+	select {
+	case <-calls:
+		t.Error("fn called after cancel")
+	default:
+	}
+}
+
+func TestWatch(t *testing.T) {
+	for _, labels := range [][]string{nil, {"INBOX", "Label_1"}} {
+		var got gmail.WatchRequest
+		c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" || r.URL.Path != "/gmail/v1/users/me/watch" {
+				t.Errorf("unexpected request %v %v", r.Method, r.URL.Path)
+			}
+			json.NewDecoder(r.Body).Decode(&got)
+			fmt.Fprint(w, `{"historyId": "1234", "expiration": "1444435200000"}`)
+		}))
+		historyID, expiration, err := c.Watch("projects/p/topics/gmail", labels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if historyID != 1234 || expiration != 1444435200000 {
+			t.Errorf("Watch = %d, %d; want 1234, 1444435200000", historyID, expiration)
+		}
+		want := gmail.WatchRequest{TopicName: "projects/p/topics/gmail", LabelIds: labels}
+		if labels != nil {
+			want.LabelFilterBehavior = "include"
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("watch request = %+v; want %+v", got, want)
+		}
+	}
+}
+
+func TestImportMessage(t *testing.T) {
+	const eml = "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: hi\r\nDate: Sat, 10 Oct 2015 12:00:00 +0000\r\n\r\nhello\r\n"
+	var got gmail.Message
+	var source string
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/gmail/v1/users/me/messages/import" {
+			t.Errorf("unexpected request %v %v", r.Method, r.URL.Path)
+		}
+		source = r.URL.Query().Get("internalDateSource")
+		json.NewDecoder(r.Body).Decode(&got)
+		fmt.Fprint(w, `{"id": "m1"}`)
+	}))
+	id, err := c.ImportMessage([]byte(eml), []string{"INBOX", "Label_1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "m1" {
+		t.Errorf("id = %q; want m1", id)
+	}
+	raw, err := base64.URLEncoding.DecodeString(got.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != eml {
+		t.Errorf("imported raw = %q; want %q", raw, eml)
+	}
+	if want := []string{"INBOX", "Label_1"}; !reflect.DeepEqual(got.LabelIds, want) {
+		t.Errorf("imported labels = %q; want %q", got.LabelIds, want)
+	}
+	if source != "dateHeader" {
+		t.Errorf("internalDateSource = %q; want dateHeader", source)
+	}
+
+	if _, err := c.ImportMessage([]byte("not a message"), nil); err == nil {
+		t.Errorf("ImportMessage of garbage succeeded")
+	}
+}
+
+func TestGerritStale(t *testing.T) {
+	defer func(old string) { *archiveOn = old }(*archiveOn)
+	tests := []struct {
+		archiveOn, status string
+		want              bool
+	}{
+		{"either", "NEW", false},
+		{"either", "MERGED", true},
+		{"either", "ABANDONED", true},
+		{"merged", "MERGED", true},
+		{"merged", "SUBMITTED", true},
+		{"merged", "ABANDONED", false},
+		{"closed", "MERGED", false},
+		{"closed", "ABANDONED", true},
+	}
+	for _, tt := range tests {
+		*archiveOn = tt.archiveOn
+		if got := pullStale(gerritState(tt.status)); got != tt.want {
+			t.Errorf("-archive-on=%s: pullStale(gerritState(%q)) = %v; want %v", tt.archiveOn, tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestExistingLabelIDs(t *testing.T) {
+	created := false
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			created = true
+		}
+		fmt.Fprint(w, `{"labels": [{"id": "INBOX", "name": "INBOX"}, {"id": "Label_3", "name": "Receipts"}]}`)
+	}))
+	got, err := c.existingLabelIDs([]string{"INBOX", "Receipts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"INBOX", "Label_3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("existingLabelIDs = %q; want %q", got, want)
+	}
+	if _, err := c.existingLabelIDs([]string{"Reciepts"}); err == nil {
+		t.Errorf("existingLabelIDs of a misspelled label succeeded")
+	}
+	if created {
+		t.Errorf("existingLabelIDs created a label")
+	}
+}
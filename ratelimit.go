@@ -0,0 +1,72 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file:
+// https://golang.org/LICENSE
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimitedTransport is a token-bucket limiter around an
+// http.RoundTripper. It keeps a client's Google API calls under the
+// per-user rate limit instead of running into 429 responses.
+type rateLimitedTransport struct {
+	rt    http.RoundTripper
+	qps   float64 // sustained requests per second
+	burst float64 // bucket size
+	now   func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimitedTransport(rt http.RoundTripper, qps float64, burst int) *rateLimitedTransport {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimitedTransport{
+		rt:     rt,
+		qps:    qps,
+		burst:  float64(burst),
+		now:    time.Now,
+		tokens: float64(burst),
+	}
+}
+
+// reserve takes a token and returns how long the caller must wait
+// before using it.
+func (t *rateLimitedTransport) reserve() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if !t.last.IsZero() {
+		t.tokens += now.Sub(t.last).Seconds() * t.qps
+		if t.tokens > t.burst {
+			t.tokens = t.burst
+		}
+	}
+	t.last = now
+	t.tokens--
+	if t.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-t.tokens / t.qps * float64(time.Second))
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if wait := t.reserve(); wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	return t.rt.RoundTrip(req)
+}
@@ -0,0 +1,38 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file:
+// https://golang.org/LICENSE
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitSpacing(t *testing.T) {
+	now := time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC)
+	rl := newRateLimitedTransport(nil, 2, 2)
+	rl.now = func() time.Time { return now }
+
+	steps := []struct {
+		advance time.Duration // clock advance before the request
+		want    time.Duration // wait before the request may go
+	}{
+		{0, 0}, // the burst
+		{0, 0},
+		{0, 500 * time.Millisecond}, // then one every 1/qps
+		{0, time.Second},
+		{1500 * time.Millisecond, 0}, // 3 tokens refilled, 2 owed
+		{0, 500 * time.Millisecond},
+		{time.Hour, 0}, // refill stops at the burst size
+		{0, 0},
+		{0, 500 * time.Millisecond},
+	}
+	for i, st := range steps {
+		now = now.Add(st.advance)
+		if got := rl.reserve(); got != st.want {
+			t.Errorf("request %d: wait %v; want %v", i, got, st.want)
+		}
+	}
+}
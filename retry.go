@@ -0,0 +1,120 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file:
+// https://golang.org/LICENSE
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// maxRetryBackoff caps the exponential backoff between attempts.
+const maxRetryBackoff = 32 * time.Second
+
+// retryTransport retries requests that fail with 429 Too Many Requests,
+// a 5xx status or a transport error, so that one transient Gmail error
+// doesn't abort a whole cleanup pass. It waits as told by Retry-After,
+// or else with jittered exponential backoff.
+type retryTransport struct {
+	rt          http.RoundTripper
+	maxAttempts int
+	base        time.Duration // backoff before the first retry; doubles after
+	sleep       func(ctx context.Context, d time.Duration) error
+}
+
+func newRetryTransport(rt http.RoundTripper, maxAttempts int, base time.Duration) *retryTransport {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &retryTransport{
+		rt:          rt,
+		maxAttempts: maxAttempts,
+		base:        base,
+		sleep:       sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A request body can only be sent again if it can be recreated.
+	rewindable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	backoff := t.base
+	for attempt := 1; ; attempt++ {
+		try := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			try = req.Clone(req.Context())
+			try.Body = body
+		}
+		res, err := t.rt.RoundTrip(try)
+		if err == nil && res.StatusCode != 429 && res.StatusCode < 500 {
+			return res, nil
+		}
+		if attempt >= t.maxAttempts || !rewindable || req.Context().Err() != nil {
+			if err != nil {
+				return nil, fmt.Errorf("%v (after %d attempts)", err, attempt)
+			}
+			slurp, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+			res.Body.Close()
+			return nil, fmt.Errorf("http status %s after %d attempts: %s", res.Status, attempt, strings.TrimSpace(string(slurp)))
+		}
+
+		// Full jitter over the upper half of the backoff, so that
+		// many clients failing together don't retry together.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if res != nil {
+			if d, ok := retryAfter(res.Header.Get("Retry-After"), time.Now()); ok {
+				wait = d
+			}
+			io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<10))
+			res.Body.Close()
+		}
+		if err := t.sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// retryAfter parses a Retry-After header value, either a number of
+// seconds or an HTTP date.
+func retryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file:
+// https://golang.org/LICENSE
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// newTestRetryClient returns an HTTP client retrying up to maxAttempts
+// times, whose backoff waits are recorded in *waits instead of slept.
+func newTestRetryClient(maxAttempts int, waits *[]time.Duration) *http.Client {
+	rt := newRetryTransport(http.DefaultTransport, maxAttempts, time.Second)
+	rt.sleep = func(ctx context.Context, d time.Duration) error {
+		*waits = append(*waits, d)
+		return nil
+	}
+	return &http.Client{Transport: rt}
+}
+
+func TestRetryTransport(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slurp, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(slurp))
+		switch len(bodies) {
+		case 1:
+			http.Error(w, "backend error", 503)
+		case 2:
+			w.Header().Set("Retry-After", "7")
+			http.Error(w, "rate limit exceeded", 429)
+		default:
+			fmt.Fprint(w, "ok")
+		}
+	}))
+	defer srv.Close()
+
+	var waits []time.Duration
+	c := newTestRetryClient(5, &waits)
+	res, err := c.Post(srv.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slurp, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || string(slurp) != "ok" {
+		t.Errorf("got %v %q; want 200 ok", res.Status, slurp)
+	}
+	if len(bodies) != 3 {
+		t.Fatalf("%d attempts; want 3", len(bodies))
+	}
+	for i, b := range bodies {
+		if b != "payload" {
+			t.Errorf("attempt %d sent body %q; want payload", i+1, b)
+		}
+	}
+	if len(waits) != 2 {
+		t.Fatalf("waits = %v; want 2", waits)
+	}
+	if waits[0] < 500*time.Millisecond || waits[0] > time.Second {
+		t.Errorf("first backoff = %v; want between 500ms and 1s", waits[0])
+	}
+	if waits[1] != 7*time.Second {
+		t.Errorf("wait after Retry-After: 7 = %v; want 7s", waits[1])
+	}
+}
+
+func TestRetryTransportGivesUp(t *testing.T) {
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, "backend error", 500)
+	}))
+	defer srv.Close()
+
+	var waits []time.Duration
+	c := newTestRetryClient(3, &waits)
+	_, err := c.Get(srv.URL)
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("error = %v; want one mentioning 3 attempts", err)
+	}
+	if attempts != 3 {
+		t.Errorf("%d attempts; want 3", attempts)
+	}
+	if len(waits) != 2 || waits[1] < time.Second || waits[1] > 2*time.Second {
+		t.Errorf("waits = %v; want 2, the second between 1s and 2s", waits)
+	}
+
+	// Other client errors aren't retried.
+	attempts = 0
+	res, err := c.Get(srv.URL + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 || attempts != 1 {
+		t.Errorf("got %v after %d attempts; want 404 after 1", res.Status, attempts)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	tests := []struct {
+		v    string
+		want time.Duration
+		ok   bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"Wed, 21 Oct 2015 07:28:30 GMT", 30 * time.Second, true},
+		{"Wed, 21 Oct 2015 07:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := retryAfter(tt.v, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%q) = %v, %v; want %v, %v", tt.v, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file:
+// https://golang.org/LICENSE
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"time"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// A rule archives, labels or trashes threads matching a Gmail query
+// and, optionally, sender and subject patterns and a minimum age.
+// Rules are loaded from the JSON file named by -rules, e.g.:
+//
+//	[
+//	  {"from": "@newsletter\\.example\\.com", "action": "archive"},
+//	  {"subject": "^\\[build\\]", "olderThan": "72h", "action": "trash"},
+//	  {"query": "in:inbox from:receipts@example.com", "action": "label", "label": "Receipts"}
+//	]
+type rule struct {
+	Query     string `json:"query"`     // Gmail search; default "in:inbox"
+	From      string `json:"from"`      // regexp matched against the first message's From
+	Subject   string `json:"subject"`   // regexp matched against the subject
+	OlderThan string `json:"olderThan"` // minimum age of the last message, e.g. "720h"
+	Action    string `json:"action"`    // "archive", "label" or "trash"
+	Label     string `json:"label"`     // label name, for action "label"
+
+	fromRE    *regexp.Regexp
+	subjectRE *regexp.Regexp
+	minAge    time.Duration
+}
+
+func loadRules(file string) ([]*rule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []*rule
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields() // catch typos like "older_than"
+	if err := dec.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("parsing rules file %v: %v", file, err)
+	}
+	for i, r := range rules {
+		if err := r.init(); err != nil {
+			return nil, fmt.Errorf("rules file %v: rule %d: %v", file, i, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *rule) init() (err error) {
+	// Refuse to trash the whole inbox because of a missing condition.
+	if r.Action == "trash" && r.Query == "" && r.From == "" && r.Subject == "" && r.OlderThan == "" {
+		return fmt.Errorf(`action "trash" requires a query, from, subject or olderThan`)
+	}
+	if r.Query == "" {
+		r.Query = "in:inbox"
+	}
+	switch r.Action {
+	case "archive", "trash":
+	case "label":
+		if r.Label == "" {
+			return fmt.Errorf(`action "label" requires a label`)
+		}
+	default:
+		return fmt.Errorf("unknown action %q; want archive, label or trash", r.Action)
+	}
+	if r.From != "" {
+		if r.fromRE, err = regexp.Compile(r.From); err != nil {
+			return fmt.Errorf("bad from pattern: %v", err)
+		}
+	}
+	if r.Subject != "" {
+		if r.subjectRE, err = regexp.Compile(r.Subject); err != nil {
+			return fmt.Errorf("bad subject pattern: %v", err)
+		}
+	}
+	if r.OlderThan != "" {
+		if r.minAge, err = time.ParseDuration(r.OlderThan); err != nil {
+			return fmt.Errorf("bad olderThan: %v", err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the thread summarized by s satisfies r's
+// sender, subject and age conditions. The query is matched by Gmail.
+func (r *rule) matches(s ThreadSummary, now time.Time) bool {
+	if r.fromRE != nil && !r.fromRE.MatchString(s.From) {
+		return false
+	}
+	if r.subjectRE != nil && !r.subjectRE.MatchString(s.Subject) {
+		return false
+	}
+	if r.minAge > 0 && now.Sub(s.LastDate) < r.minAge {
+		return false
+	}
+	return true
+}
+
+// ApplyRules runs each rule's action on the threads it matches,
+// counting them in stats. If dryRun is true, matches are only logged.
+// Failures are logged and counted in stats.Errors; a failed rule or
+// thread doesn't stop the others.
+func (c *FewerClient) ApplyRules(rules []*rule, dryRun bool, stats *cleanupStats) {
+	now := time.Now()
+	for _, r := range rules {
+		var labelID string
+		if r.Action == "label" {
+			// In a dry run, don't create the label; if it doesn't
+			// exist yet, no thread has it.
+			var err error
+			if dryRun {
+				labelID, err = c.lookupLabel(r.Label)
+			} else {
+				labelID, err = c.LabelID(r.Label)
+			}
+			if err != nil {
+				log.Printf("Rule %q: %v", r.Query, err)
+				stats.Errors++
+				continue
+			}
+		}
+		if err := c.ForeachThread(r.Query, func(t *gmail.Thread) error {
+			s, err := c.SummarizeThread(t.Id)
+			if err != nil {
+				log.Printf("Rule %q: summarizing thread %v: %v", r.Query, t.Id, err)
+				stats.Errors++
+				return nil
+			}
+			if !r.matches(s, now) {
+				return nil
+			}
+			// Labeling leaves the thread in the rule's query, so
+			// don't relabel it on every -watch pass.
+			if labelID != "" && hasLabel(s, labelID) {
+				return nil
+			}
+			if dryRun {
+				log.Printf("Would %s thread %v %q (rule %q)", r.Action, s.ID, s.Subject, r.Query)
+			} else {
+				log.Printf("Rule %q: %s thread %v %q", r.Query, r.Action, s.ID, s.Subject)
+				switch r.Action {
+				case "archive":
+					err = c.ArchiveThread(t.Id)
+				case "trash":
+					err = c.TrashThread(t.Id)
+				default:
+					err = c.LabelThread(t.Id, []string{labelID}, false)
+				}
+				if err != nil {
+					log.Printf("Rule %q: %s thread %v: %v", r.Query, r.Action, s.ID, err)
+					stats.Errors++
+					return nil
+				}
+			}
+			switch r.Action {
+			case "archive":
+				stats.Archived++
+			case "trash":
+				stats.Trashed++
+			default:
+				stats.Labeled++
+			}
+			return nil
+		}); err != nil {
+			log.Printf("Rule %q: %v", r.Query, err)
+			stats.Errors++
+		}
+	}
+}
+
+func hasLabel(s ThreadSummary, labelID string) bool {
+	for _, l := range s.Labels {
+		if l == labelID {
+			return true
+		}
+	}
+	return false
+}
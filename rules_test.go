@@ -0,0 +1,183 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file:
+// https://golang.org/LICENSE
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+func TestRuleMatches(t *testing.T) {
+	now := time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		r    rule
+		s    ThreadSummary
+		want bool
+	}{
+		{
+			name: "sender archive",
+			r:    rule{From: `@newsletter\.example\.com`, Action: "archive"},
+			s:    ThreadSummary{From: "News <weekly@newsletter.example.com>", LastDate: now},
+			want: true,
+		},
+		{
+			name: "other sender",
+			r:    rule{From: `@newsletter\.example\.com`, Action: "archive"},
+			s:    ThreadSummary{From: "Alice <alice@example.com>", LastDate: now},
+			want: false,
+		},
+		{
+			name: "old enough",
+			r:    rule{Subject: `^\[build\]`, OlderThan: "72h", Action: "trash"},
+			s:    ThreadSummary{Subject: "[build] broken", LastDate: now.Add(-73 * time.Hour)},
+			want: true,
+		},
+		{
+			name: "too recent",
+			r:    rule{Subject: `^\[build\]`, OlderThan: "72h", Action: "trash"},
+			s:    ThreadSummary{Subject: "[build] broken", LastDate: now.Add(-71 * time.Hour)},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		r := tt.r
+		if err := r.init(); err != nil {
+			t.Errorf("%s: init: %v", tt.name, err)
+			continue
+		}
+		if r.Query != "in:inbox" {
+			t.Errorf("%s: default query = %q; want in:inbox", tt.name, r.Query)
+		}
+		if got := r.matches(tt.s, now); got != tt.want {
+			t.Errorf("%s: matches = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRuleInitErrors(t *testing.T) {
+	for _, r := range []rule{
+		{Action: "delete"},
+		{Action: "label"},
+		{Action: "trash"},
+		{From: "(", Action: "archive"},
+		{OlderThan: "3 days", Action: "archive"},
+	} {
+		if err := r.init(); err == nil {
+			t.Errorf("init(%+v) succeeded; want error", r)
+		}
+	}
+}
+
+func TestLoadRulesUnknownField(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rules.json")
+	if err := ioutil.WriteFile(file, []byte(`[{"from": "x", "older_than": "24h", "action": "archive"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadRules(file)
+	if err == nil || !strings.Contains(err.Error(), "older_than") {
+		t.Errorf("loadRules error = %v; want unknown field older_than", err)
+	}
+}
+
+func TestApplyRulesContinuesAfterErrors(t *testing.T) {
+	var acted []string
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "/gmail/v1/users/me/threads"
+		switch {
+		case r.Method == "GET" && r.URL.Path == prefix:
+			fmt.Fprint(w, `{"threads": [{"id": "a"}, {"id": "b"}, {"id": "c"}]}`)
+		case r.Method == "GET" && r.URL.Path == prefix+"/c":
+			http.Error(w, `{"error": {"code": 500, "message": "backend error"}}`, 500)
+		case r.Method == "GET":
+			json.NewEncoder(w).Encode(&gmail.Thread{
+				Id:       path.Base(r.URL.Path),
+				Messages: []*gmail.Message{testMessage(nil, 0, "Subject", "[build] broken")},
+			})
+		case r.Method == "POST":
+			tid, action := path.Base(path.Dir(r.URL.Path)), path.Base(r.URL.Path)
+			acted = append(acted, action+" "+tid)
+			if tid == "a" && action == "trash" {
+				http.Error(w, `{"error": {"code": 500, "message": "backend error"}}`, 500)
+				return
+			}
+			fmt.Fprint(w, "{}")
+		}
+	}))
+	rules := []*rule{
+		{Subject: `^\[build\]`, Action: "trash"},
+		{Query: "label:other", Action: "archive"},
+	}
+	for _, r := range rules {
+		if err := r.init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var stats cleanupStats
+	c.ApplyRules(rules, false, &stats)
+	want := []string{"trash a", "trash b", "modify a", "modify b"}
+	if !reflect.DeepEqual(acted, want) {
+		t.Errorf("actions = %q; want %q", acted, want)
+	}
+	// a's trash failed and c couldn't be read, for both rules.
+	if want := (cleanupStats{Archived: 2, Trashed: 1, Errors: 3}); stats != want {
+		t.Errorf("stats = %+v; want %+v", stats, want)
+	}
+}
+
+func TestApplyRulesSkipsLabeled(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		var labeled []string
+		c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			const prefix = "/gmail/v1/users/me/threads"
+			switch {
+			case r.URL.Path == "/gmail/v1/users/me/labels":
+				fmt.Fprint(w, `{"labels": [{"id": "Label_7", "name": "Receipts"}]}`)
+			case r.Method == "GET" && r.URL.Path == prefix:
+				fmt.Fprint(w, `{"threads": [{"id": "new"}, {"id": "done"}]}`)
+			case r.Method == "GET":
+				tid := path.Base(r.URL.Path)
+				labels := []string{"INBOX"}
+				if tid == "done" {
+					labels = append(labels, "Label_7")
+				}
+				json.NewEncoder(w).Encode(&gmail.Thread{Id: tid, Messages: []*gmail.Message{testMessage(labels, 0)}})
+			case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/modify"):
+				labeled = append(labeled, path.Base(path.Dir(r.URL.Path)))
+				fmt.Fprint(w, "{}")
+			default:
+				t.Errorf("unexpected request %v %v", r.Method, r.URL.Path)
+				http.NotFound(w, r)
+			}
+		}))
+		r := &rule{Action: "label", Label: "Receipts"}
+		if err := r.init(); err != nil {
+			t.Fatal(err)
+		}
+		var stats cleanupStats
+		c.ApplyRules([]*rule{r}, dryRun, &stats)
+		if stats.Labeled != 1 || stats.Errors != 0 {
+			t.Errorf("dryRun=%v: stats = %+v; want 1 labeled", dryRun, stats)
+		}
+		var want []string
+		if !dryRun {
+			want = []string{"new"}
+		}
+		if !reflect.DeepEqual(labeled, want) {
+			t.Errorf("dryRun=%v: labeled %q; want %q", dryRun, labeled, want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file:
+// https://golang.org/LICENSE
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// Gmail's own snooze isn't available through the API, so it is
+// emulated: a snoozed thread is archived and recorded, with its wake
+// time, in a JSON file in the cache directory. Each cleanup pass moves
+// due threads back to the inbox.
+
+// Snoozed returns the snoozed threads, keyed by thread ID, and when
+// each is due back in the inbox.
+func (c *FewerClient) Snoozed() (map[string]time.Time, error) {
+	slurp, err := ioutil.ReadFile(c.snoozeFile)
+	if os.IsNotExist(err) {
+		return map[string]time.Time{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]time.Time{}
+	if err := json.Unmarshal(slurp, &m); err != nil {
+		return nil, fmt.Errorf("parsing %v: %v", c.snoozeFile, err)
+	}
+	return m, nil
+}
+
+func (c *FewerClient) saveSnoozed(m map[string]time.Time) error {
+	slurp, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(c.snoozeFile), 0700)
+	tmp := c.snoozeFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, slurp, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.snoozeFile)
+}
+
+// staleLockAge is how old a snooze lock file must be before it is
+// assumed to be left over from a crashed run. The lock is only held
+// while the small state file is rewritten.
+const staleLockAge = 10 * time.Second
+
+// updateSnoozed applies fn to the snoozed threads and saves the result.
+// The read-modify-write is done under a lock file, so that a -snooze
+// run doesn't lose its record to a concurrent -watch pass, or the
+// reverse.
+func (c *FewerClient) updateSnoozed(fn func(m map[string]time.Time)) error {
+	lock := c.snoozeFile + ".lock"
+	os.MkdirAll(filepath.Dir(lock), 0700)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if fi, err := os.Stat(lock); err == nil && time.Since(fi.ModTime()) > staleLockAge {
+			log.Printf("Removing stale lock %v", lock)
+			os.Remove(lock)
+			continue
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	defer os.Remove(lock)
+
+	m, err := c.Snoozed()
+	if err != nil {
+		return err
+	}
+	fn(m)
+	return c.saveSnoozed(m)
+}
+
+// SnoozeThread archives the thread now and records it to be returned
+// to the inbox at until. The record is written first, so that a thread
+// is never archived without one.
+func (c *FewerClient) SnoozeThread(tid string, until time.Time) error {
+	var prev time.Time
+	var wasSnoozed bool
+	if err := c.updateSnoozed(func(m map[string]time.Time) {
+		prev, wasSnoozed = m[tid]
+		m[tid] = until
+	}); err != nil {
+		return err
+	}
+	if err := c.ArchiveThread(tid); err != nil {
+		if err := c.updateSnoozed(func(m map[string]time.Time) {
+			if wasSnoozed {
+				m[tid] = prev
+			} else {
+				delete(m, tid)
+			}
+		}); err != nil {
+			log.Printf("Restoring %v: %v", c.snoozeFile, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// UnsnoozeThread cancels the snooze of thread tid, moving it back to
+// the inbox now.
+func (c *FewerClient) UnsnoozeThread(tid string) error {
+	m, err := c.Snoozed()
+	if err != nil {
+		return err
+	}
+	if _, ok := m[tid]; !ok {
+		return fmt.Errorf("thread %v is not snoozed", tid)
+	}
+	if err := c.inboxThread(tid); err != nil {
+		return err
+	}
+	return c.updateSnoozed(func(m map[string]time.Time) {
+		delete(m, tid)
+	})
+}
+
+// inboxThread moves the thread back to the inbox.
+func (c *FewerClient) inboxThread(tid string) error {
+	_, err := c.svc.Threads.Modify("me", tid, &gmail.ModifyThreadRequest{
+		AddLabelIds: []string{"INBOX"},
+	}).Do()
+	return err
+}
+
+// dueSnoozes returns the IDs of the threads in m due at or before now,
+// earliest first.
+func dueSnoozes(m map[string]time.Time, now time.Time) []string {
+	var due []string
+	for tid, until := range m {
+		if !until.After(now) {
+			due = append(due, tid)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if ti, tj := m[due[i]], m[due[j]]; !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return due[i] < due[j]
+	})
+	return due
+}
+
+// UnsnoozeDue moves every snoozed thread that is due back to the inbox
+// and returns how many were moved. If dryRun is true, due threads are
+// only logged.
+func (c *FewerClient) UnsnoozeDue(now time.Time, dryRun bool) (int, error) {
+	m, err := c.Snoozed()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	var done []string
+	for _, tid := range dueSnoozes(m, now) {
+		if dryRun {
+			log.Printf("Would unsnooze thread %v (due %v)", tid, m[tid])
+			n++
+			continue
+		}
+		if err := c.inboxThread(tid); err != nil {
+			log.Printf("Unsnoozing thread %v: %v", tid, err)
+			continue
+		}
+		log.Printf("Unsnoozed thread %v (due %v)", tid, m[tid])
+		done = append(done, tid)
+	}
+	if len(done) == 0 {
+		return n, nil
+	}
+	// The Modify calls can take a while; re-read the file so that
+	// snoozes recorded meanwhile are kept. A thread re-snoozed in
+	// the meantime keeps its new time.
+	return len(done), c.updateSnoozed(func(cur map[string]time.Time) {
+		for _, tid := range done {
+			if cur[tid].Equal(m[tid]) {
+				delete(cur, tid)
+			}
+		}
+	})
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file:
+// https://golang.org/LICENSE
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDueSnoozes(t *testing.T) {
+	now := time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC)
+	m := map[string]time.Time{
+		"late":   now.Add(time.Hour),
+		"b":      now.Add(-time.Hour),
+		"a":      now.Add(-time.Hour),
+		"first":  now.Add(-48 * time.Hour),
+		"exact":  now,
+		"future": now.Add(24 * time.Hour),
+	}
+	got := dueSnoozes(m, now)
+	want := []string{"first", "a", "b", "exact"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dueSnoozes = %q; want %q", got, want)
+	}
+}
+
+func TestUnsnoozeDue(t *testing.T) {
+	now := time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC)
+	for _, dryRun := range []bool{true, false} {
+		var modified []string
+		c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tid := path.Base(path.Dir(r.URL.Path))
+			modified = append(modified, tid)
+			if tid == "fails" {
+				http.Error(w, `{"error": {"code": 500, "message": "backend error"}}`, 500)
+				return
+			}
+			fmt.Fprint(w, "{}")
+		}))
+		c.snoozeFile = filepath.Join(t.TempDir(), "snoozed.json")
+		if err := c.saveSnoozed(map[string]time.Time{
+			"due":    now.Add(-time.Minute),
+			"fails":  now.Add(-time.Hour),
+			"future": now.Add(time.Hour),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := c.UnsnoozeDue(now, dryRun)
+		if err != nil {
+			t.Fatalf("dryRun=%v: %v", dryRun, err)
+		}
+		m, err := c.Snoozed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var left []string
+		for tid := range m {
+			left = append(left, tid)
+		}
+		if dryRun {
+			if n != 2 || modified != nil || len(left) != 3 {
+				t.Errorf("dry run: n = %d, modified %q, %d left; want 2, none, 3", n, modified, len(left))
+			}
+			continue
+		}
+		if n != 1 {
+			t.Errorf("unsnoozed %d; want 1", n)
+		}
+		if want := []string{"fails", "due"}; !reflect.DeepEqual(modified, want) {
+			t.Errorf("modified %q; want %q", modified, want)
+		}
+		if _, ok := m["due"]; ok || len(m) != 2 {
+			t.Errorf("still snoozed: %v; want fails and future", m)
+		}
+	}
+}
+
+func TestSnoozeThreadArchiveFails(t *testing.T) {
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, 404)
+	}))
+	c.snoozeFile = filepath.Join(t.TempDir(), "snoozed.json")
+	if err := c.SnoozeThread("t1", time.Now().Add(time.Hour)); err == nil {
+		t.Fatal("SnoozeThread succeeded; want archive error")
+	}
+	m, err := c.Snoozed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 0 {
+		t.Errorf("snoozed after failed archive: %v", m)
+	}
+}
+
+func TestCleanupCorruptSnoozeFile(t *testing.T) {
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "{}") // empty inbox
+	}))
+	c.snoozeFile = filepath.Join(t.TempDir(), "snoozed.json")
+	if err := ioutil.WriteFile(c.snoozeFile, []byte("{garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Cleanup(nil, false); err != nil {
+		t.Errorf("Cleanup with corrupt snooze file: %v", err)
+	}
+}
+
+func TestUnsnoozeDueKeepsConcurrentSnoozes(t *testing.T) {
+	now := time.Date(2015, 10, 1, 12, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+	var c *FewerClient
+	c = newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// While "due" is being moved back to the inbox, another run
+		// snoozes "new" and re-snoozes "again".
+		if path.Base(path.Dir(r.URL.Path)) == "due" {
+			if err := c.updateSnoozed(func(m map[string]time.Time) {
+				m["new"] = later
+				m["again"] = later
+			}); err != nil {
+				t.Error(err)
+			}
+		}
+		fmt.Fprint(w, "{}")
+	}))
+	c.snoozeFile = filepath.Join(t.TempDir(), "snoozed.json")
+	if err := c.saveSnoozed(map[string]time.Time{
+		"again": now.Add(-time.Hour),
+		"due":   now.Add(-time.Minute),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.UnsnoozeDue(now, false); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.Snoozed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || !m["new"].Equal(later) || !m["again"].Equal(later) {
+		t.Errorf("snoozed = %v; want new and again at %v", m, later)
+	}
+}
+
+func TestUnsnoozeThread(t *testing.T) {
+	var got []string
+	c := newTestClient(t, recordRequests(&got))
+	c.snoozeFile = filepath.Join(t.TempDir(), "snoozed.json")
+	later := time.Now().Add(time.Hour)
+	if err := c.saveSnoozed(map[string]time.Time{"t1": later, "t2": later}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UnsnoozeThread("t1"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"POST /gmail/v1/users/me/threads/t1/modify"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("requests = %q; want %q", got, want)
+	}
+	m, err := c.Snoozed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["t1"]; ok || len(m) != 1 {
+		t.Errorf("snoozed = %v; want only t2", m)
+	}
+	if err := c.UnsnoozeThread("t3"); err == nil {
+		t.Errorf("UnsnoozeThread of a thread that isn't snoozed succeeded")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file:
+// https://golang.org/LICENSE
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// tokenKeyEnv names the environment variable that, if set, holds the
+// key used to encrypt the cached Gmail token with AES-256-GCM: the
+// base64 of 32 random bytes, as from "head -c32 /dev/urandom | base64".
+// A passphrase isn't accepted, since it would be cheap to brute-force
+// from the file.
+const tokenKeyEnv = "INBOXFEWER_TOKEN_KEY"
+
+// encryptedTokenPrefix marks an encrypted token file. It is followed by
+// the base64 of the nonce and the sealed token.
+const encryptedTokenPrefix = "aesgcm:"
+
+func tokenCipher() (cipher.AEAD, error) {
+	v := os.Getenv(tokenKeyEnv)
+	if v == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("$%s must be the base64 of 32 random bytes (try: head -c32 /dev/urandom | base64)", tokenKeyEnv)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readTokenFile returns the contents of the token cache file,
+// decrypting it if needed. A plaintext file is rewritten encrypted
+// when a key is configured.
+func readTokenFile(file string) (string, error) {
+	slurp, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	aead, err := tokenCipher()
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimSpace(string(slurp))
+	if !strings.HasPrefix(s, encryptedTokenPrefix) {
+		if aead != nil {
+			if err := writeTokenFile(file, s); err != nil {
+				log.Printf("Encrypting plaintext token file %v: %v", file, err)
+			}
+		}
+		return s, nil
+	}
+	if aead == nil {
+		return "", fmt.Errorf("%v is encrypted but $%s is not set", file, tokenKeyEnv)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, encryptedTokenPrefix))
+	if err != nil {
+		return "", fmt.Errorf("decoding %v: %v", file, err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("%v is truncated", file)
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", errors.New("decrypting " + file + ": wrong key or corrupt file")
+	}
+	return string(plain), nil
+}
+
+// writeTokenFile writes contents to the token cache file, encrypted if
+// a key is configured.
+func writeTokenFile(file, contents string) error {
+	aead, err := tokenCipher()
+	if err != nil {
+		return err
+	}
+	if aead != nil {
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		sealed := aead.Seal(nonce, nonce, []byte(contents), nil)
+		contents = encryptedTokenPrefix + base64.StdEncoding.EncodeToString(sealed)
+	}
+	// Write and rename, so that a crash can't truncate the only copy
+	// of the token.
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(contents), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// tokenRevokeURL is Google's OAuth 2.0 token revocation endpoint.
+var tokenRevokeURL = "https://oauth2.googleapis.com/revoke"
+
+// removeTokenFile revokes the cached token with Google, so the grant no
+// longer appears in the account's third-party access list, and deletes
+// the cache file. The file is deleted even if the token can't be read
+// or revoked; those failures are only logged. A missing file is not an
+// error.
+func removeTokenFile(file string) error {
+	if cached, err := readTokenFile(file); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: not revoking cached token: %v", err)
+		}
+	} else if err := revokeToken(cached); err != nil {
+		log.Printf("Warning: revoking cached token: %v", err)
+	}
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// revokeToken revokes the refresh token in the cached "access refresh"
+// token string.
+func revokeToken(cached string) error {
+	f := strings.Fields(cached)
+	if len(f) != 2 {
+		return errors.New("malformed cached token")
+	}
+	// Revoking the refresh token also revokes its access tokens.
+	res, err := apiClient.PostForm(tokenRevokeURL, url.Values{"token": {f[1]}})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	// 400 means the token was already invalid.
+	if res.StatusCode != 200 && res.StatusCode != 400 {
+		return fmt.Errorf("http status %s", res.Status)
+	}
+	return nil
+}
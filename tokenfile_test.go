@@ -0,0 +1,136 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file:
+// https://golang.org/LICENSE
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testToken = "access-token refresh-token"
+
+// Valid $INBOXFEWER_TOKEN_KEY values.
+const (
+	testKey  = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+	otherKey = "ICEiIyQlJicoKSorLC0uLzAxMjM0NTY3ODk6Ozw9Pj8="
+)
+
+func TestTokenFileRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gmail.token")
+	t.Setenv(tokenKeyEnv, testKey)
+	if err := writeTokenFile(file, testToken); err != nil {
+		t.Fatal(err)
+	}
+	slurp, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(slurp), encryptedTokenPrefix) || strings.Contains(string(slurp), "refresh-token") {
+		t.Errorf("token file isn't encrypted: %q", slurp)
+	}
+	got, err := readTokenFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != testToken {
+		t.Errorf("readTokenFile = %q; want %q", got, testToken)
+	}
+}
+
+func TestTokenFileWrongKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gmail.token")
+	t.Setenv(tokenKeyEnv, testKey)
+	if err := writeTokenFile(file, testToken); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{otherKey, ""} {
+		t.Setenv(tokenKeyEnv, key)
+		if got, err := readTokenFile(file); err == nil {
+			t.Errorf("key %q: readTokenFile = %q; want error", key, got)
+		}
+	}
+}
+
+func TestTokenFileEncryptsPlaintext(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gmail.token")
+	if err := ioutil.WriteFile(file, []byte(testToken+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(tokenKeyEnv, testKey)
+	got, err := readTokenFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != testToken {
+		t.Errorf("readTokenFile = %q; want %q", got, testToken)
+	}
+	slurp, _ := ioutil.ReadFile(file)
+	if !strings.HasPrefix(string(slurp), encryptedTokenPrefix) {
+		t.Errorf("plaintext token file wasn't rewritten encrypted: %q", slurp)
+	}
+}
+
+func TestRemoveTokenFile(t *testing.T) {
+	var revoked []string
+	status := 200
+	server := withAPIServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		revoked = append(revoked, r.FormValue("token"))
+		w.WriteHeader(status)
+	}))
+	defer func(old string) { tokenRevokeURL = old }(tokenRevokeURL)
+	tokenRevokeURL = "https://" + server + "/revoke"
+
+	tests := []struct {
+		name        string
+		status      int    // revoke endpoint response
+		readKey     string // $INBOXFEWER_TOKEN_KEY when removing
+		wantRevoked []string
+		noFile      bool // no cached token to begin with
+	}{
+		{"revoked", 200, testKey, []string{"refresh-token"}, false},
+		{"revoke fails", 503, testKey, []string{"refresh-token"}, false},
+		{"wrong key", 200, otherKey, nil, false},
+		{"no file", 200, testKey, nil, true},
+	}
+	for _, tt := range tests {
+		revoked, status = nil, tt.status
+		file := filepath.Join(t.TempDir(), "gmail.token")
+		t.Setenv(tokenKeyEnv, testKey)
+		if !tt.noFile {
+			if err := writeTokenFile(file, testToken); err != nil {
+				t.Fatal(err)
+			}
+		}
+		t.Setenv(tokenKeyEnv, tt.readKey)
+		if err := removeTokenFile(file); err != nil {
+			t.Errorf("%s: removeTokenFile: %v", tt.name, err)
+		}
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s: token file still exists (stat error %v)", tt.name, err)
+		}
+		if !reflect.DeepEqual(revoked, tt.wantRevoked) {
+			t.Errorf("%s: revoked %q; want %q", tt.name, revoked, tt.wantRevoked)
+		}
+	}
+}
+
+func TestTokenKeyMustBeRandom(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gmail.token")
+	for _, key := range []string{"correct horse battery staple", "c2hvcnQ="} {
+		t.Setenv(tokenKeyEnv, key)
+		if err := writeTokenFile(file, testToken); err == nil {
+			t.Errorf("writeTokenFile with key %q succeeded", key)
+		}
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("token file written with an invalid key (stat error %v)", err)
+	}
+}